@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"strconv"
 	"time"
 
+	"brainyping/pkg/checks"
 	"brainyping/pkg/dbhelper"
 	"brainyping/pkg/initapp"
 	"brainyping/pkg/settings"
@@ -101,6 +103,8 @@ func readAndWrite() {
 			OwnerUid:           settings.GetSettStr(BLOWNERUID),
 		}
 		record.Name = scanner.Text() + record.Type + record.SubType
+		// make sure we are not loading checks the workers are not able to process
+		utilities.FailOnError(checks.ValidateRecord(record))
 		recordsToSave = append(recordsToSave, record)
 		recsSaved++
 		recsInBufferList++
@@ -141,13 +145,20 @@ func createRegionsList() [][]string {
 	regions, err := settings.GetRegionsList()
 	utilities.FailOnError(err)
 
+	enabled := settings.EnabledSubRegions(regions)
+
 	for _, r := range regions {
-		// todo check if region is enabled....
 		for _, sr := range r.SubRegions {
-			// todo check if subregion is enabled
+			if !enabled[settings.SubRegionKey(r.Id, sr.Id)] {
+				continue
+			}
 			regionsListToReturn = append(regionsListToReturn, []string{r.Id, sr.Id})
 		}
 	}
 
+	if len(regionsListToReturn) == 0 {
+		utilities.FailOnError(errors.New("no regions/subregions enabled, checks would never be scheduled"))
+	}
+
 	return regionsListToReturn
 }
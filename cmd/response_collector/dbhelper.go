@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"brainyping/pkg/dbhelper"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// robotsTxtChanged saves the robots.txt hash of the response on the check, true if the check had a different hash before
+// the check keeps only the last hash seen so the previous one doesn't need to be looked up in the responses
+func robotsTxtChanged(response dbhelper.CheckResponseRecordDb) bool {
+	var previous dbhelper.CheckRecord
+
+	if response.RobotsTxtHash == "" {
+		return false
+	}
+
+	// nothing is updated if the hash didn't change, the check updated time is not touched so the scheduler doesn't reload it
+	filter := bson.M{"checkid": response.CheckId, "robotstxthash": bson.M{"$ne": response.RobotsTxtHash}}
+	update := bson.M{"$set": bson.M{"robotstxthash": response.RobotsTxtHash}}
+	opts := options.FindOneAndUpdate().SetProjection(bson.M{"robotstxthash": 1}).SetReturnDocument(options.Before)
+	err := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameChecks).FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&previous)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Error while saving robots.txt hash of check [%s]: %s\n", response.CheckId, err.Error())
+		}
+		return false
+	}
+
+	// the first hash seen is not a change
+	return previous.RobotsTxtHash != ""
+}
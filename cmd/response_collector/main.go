@@ -107,7 +107,9 @@ forloop:
 				metadata.msgFailed++
 			}
 			messageQueued.ReceivedByResponseHandler = time.Now().Unix()
-			chsave <- prepareRecordToBeSaved(messageQueued)
+			record := prepareRecordToBeSaved(messageQueued)
+			record.RobotsTxtChanged = robotsTxtChanged(record)
+			chsave <- record
 			_ = response.Ack(false)
 		case <-ctx.Done():
 			metadata.inGracePeriod = true
@@ -169,6 +171,8 @@ func prepareRecordToBeSaved(record queuehelper.CheckRecordQueued) dbhelper.Check
 	response.Region = record.RecordOutcome.Region
 	response.SubRegion = record.RecordOutcome.SubRegion
 	response.QueuedRequestUnix = record.QueuedUnix
+	// scheduled time delay is the end to end drift, scheduler delay only the part spent before the request was queued
+	response.SchedulerDelay = record.QueuedUnix - record.ScheduledUnix
 	response.ReceivedByWorkerUnix = record.ReceivedByWorkerUnix
 	response.QueuedResponseUnix = record.QueuedReturnUnix
 	response.ReceivedResponseUnix = record.ReceivedByResponseHandler
@@ -183,10 +187,50 @@ func prepareRecordToBeSaved(record queuehelper.CheckRecordQueued) dbhelper.Check
 	response.RedirectsHistory = record.RecordOutcome.RedirectsHistory
 	response.CreatedUnix = time.Now().Unix()
 	response.RequestId = record.RequestId
+	response.ConfirmationOf = record.ConfirmationOf
+	response.RunId = record.RunId
+	response.RunRegions = record.RunRegions
+	response.ConfirmationsRequested = record.ConfirmationsRequested
+	response.ConfirmQuorum = record.ConfirmQuorum
 	response.WorkerHostname = record.WorkerHostname
 	response.WorkerHostnameFriendly = record.WorkerHostnameFriendly
 	response.Attempts = record.Attempts
+	response.InFlightRequeues = record.InFlightRequeues
 	response.ContentLength = record.RecordOutcome.ContentLength
+	response.ResolvedIp = record.RecordOutcome.ResolvedIp
+	response.ConnectTime = record.RecordOutcome.ConnectTime
+	response.TlsHandshakeTime = record.RecordOutcome.TlsHandshakeTime
+	response.TtfbTime = record.RecordOutcome.TtfbTime
+	response.TransferTime = record.RecordOutcome.TransferTime
+	response.FailedAssertion = record.RecordOutcome.FailedAssertion
+	response.RobotsTxtExists = record.RecordOutcome.RobotsTxtExists
+	response.RobotsTxtBlocksAll = record.RecordOutcome.RobotsTxtBlocksAll
+	response.RobotsTxtHash = record.RecordOutcome.RobotsTxtHash
+	response.TlsDaysToExpiry = record.RecordOutcome.TlsDaysToExpiry
+	response.TlsNotAfterUnix = record.RecordOutcome.TlsNotAfterUnix
+	response.TlsIssuer = record.RecordOutcome.TlsIssuer
+	response.TlsSans = record.RecordOutcome.TlsSans
+	response.TlsHostnameMatch = record.RecordOutcome.TlsHostnameMatch
+	response.TlsChainValid = record.RecordOutcome.TlsChainValid
+	response.DnsTime = record.RecordOutcome.DnsTime
+	response.DnsAnswers = record.RecordOutcome.DnsAnswers
+	response.Degraded = record.RecordOutcome.Degraded
+	response.BodyTruncated = record.RecordOutcome.BodyTruncated
+	response.AssertionsResults = record.RecordOutcome.AssertionsResults
+	response.StepsResults = record.RecordOutcome.StepsResults
+	response.FailedStep = record.RecordOutcome.FailedStep
+	response.PingSent = record.RecordOutcome.PingSent
+	response.PingReceived = record.RecordOutcome.PingReceived
+	response.PingLossPerc = record.RecordOutcome.PingLossPerc
+	response.PingMinTime = record.RecordOutcome.PingMinTime
+	response.PingAvgTime = record.RecordOutcome.PingAvgTime
+	response.PingMaxTime = record.RecordOutcome.PingMaxTime
+	response.PingJitter = record.RecordOutcome.PingJitter
+	response.ErrorCode = record.RecordOutcome.ErrorCode
+	response.MailBanner = record.RecordOutcome.MailBanner
+	response.MailCapabilities = record.RecordOutcome.MailCapabilities
+	response.MailBannerTime = record.RecordOutcome.MailBannerTime
+	response.MailStartTlsDone = record.RecordOutcome.MailStartTlsDone
 
 	return response
 
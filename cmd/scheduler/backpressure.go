@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/queuehelper"
+	"brainyping/pkg/settings"
+)
+
+// when the workers of a region are down (or too slow) its requests queue keeps growing and checks are executed late, or never.
+// The depth of the requests queues is read periodically and, when a queue is backed up, the policy decides what to do
+// with the requests for that region. Requests waiting too long in a queue expire (see QUEUE_REQUEST_TTL_MS) and are dead-lettered
+
+const SCHBACKPRESSUREREFRESHMS = "SCH_BACKPRESSURE_REFRESH_MS"
+const SCHBACKPRESSUREMAXDEPTH = "SCH_BACKPRESSURE_MAX_DEPTH"
+const SCHBACKPRESSUREPOLICY = "SCH_BACKPRESSURE_POLICY"
+
+// policies applied to the requests for a region with the queue backed up
+const BACKPRESSUREPOLICYSKIP = "SKIP"       // the request is not sent, a "not executed" response is recorded
+const BACKPRESSUREPOLICYREROUTE = "REROUTE" // the request is sent to another region of the check not backed up, skipped if there's none
+const BACKPRESSUREPOLICYPUBLISH = "PUBLISH" // the request is sent anyway
+
+// requests waiting in the queues by region.subregion, refreshed while the scheduler is running
+var queuesDepth = map[string]int{}
+var queuesDepthMutex = sync.RWMutex{}
+
+var jobsSkippedBecauseBackedUp int64
+var jobsReroutedBecauseBackedUp int64
+var jobsExpiredInQueue int64
+
+func monitorQueuesDepthWhileSchedulerIsRunning() {
+	if settings.GetSettDuration(SCHBACKPRESSUREREFRESHMS) <= 0 || settings.GetSettInt(SCHBACKPRESSUREMAXDEPTH) <= 0 {
+		log.Println("Backpressure disabled, requests are queued regardless of the queues depth")
+		return
+	}
+	for {
+		refreshQueuesDepth()
+		time.Sleep(settings.GetSettDuration(SCHBACKPRESSUREREFRESHMS) * time.Millisecond)
+	}
+}
+
+func refreshQueuesDepth() {
+	var depths = map[string]int{}
+	var subRegions [][]string
+
+	regions, err := settings.GetRegionsList()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, r := range regions {
+		for _, sr := range r.SubRegions {
+			subRegions = append(subRegions, []string{r.Id, sr.Id})
+		}
+	}
+
+	// only the queues of the enabled subregions are declared by the scheduler, a passive declare of a missing queue fails
+	for _, k := range enabledRegionsOnly(subRegions) {
+		depth, err := queuehelper.RequestsQueueDepth(k[0], k[1])
+		if err != nil {
+			log.Printf("Error while reading depth of the requests queue %s.%s: %s\n", k[0], k[1], err.Error())
+			continue
+		}
+		depths[settings.SubRegionKey(k[0], k[1])] = depth
+	}
+
+	queuesDepthMutex.Lock()
+	queuesDepth = depths
+	queuesDepthMutex.Unlock()
+}
+
+// queueBackedUp returns true if the requests queue of the region/subregion has more requests waiting than the max depth
+func queueBackedUp(region string, subRegion string) bool {
+	maxDepth := settings.GetSettInt(SCHBACKPRESSUREMAXDEPTH)
+	if maxDepth <= 0 {
+		return false
+	}
+	queuesDepthMutex.RLock()
+	defer queuesDepthMutex.RUnlock()
+
+	return queuesDepth[settings.SubRegionKey(region, subRegion)] >= maxDepth
+}
+
+// queueWithBackpressure sends the request to the region/subregion, unless its queue is backed up
+func queueWithBackpressure(record queuehelper.CheckRecordQueued, region string, subRegion string) {
+	if !queueBackedUp(region, subRegion) {
+		queueForRegion(record, region, subRegion)
+		return
+	}
+
+	switch settings.GetSettStr(SCHBACKPRESSUREPOLICY) {
+	case BACKPRESSUREPOLICYPUBLISH:
+		queueForRegion(record, region, subRegion)
+		return
+	case BACKPRESSUREPOLICYREROUTE:
+		var candidates [][]string
+		for _, r := range requeueCandidates(record.Record.Regions, region, subRegion) {
+			if !queueBackedUp(r[0], r[1]) {
+				candidates = append(candidates, r)
+			}
+		}
+		if len(candidates) > 0 {
+			target := candidates[rand.Intn(len(candidates))]
+			atomic.AddInt64(&jobsReroutedBecauseBackedUp, 1)
+			queueForRegion(record, target[0], target[1])
+			return
+		}
+	}
+
+	// SKIP, or REROUTE without a region available
+	atomic.AddInt64(&jobsSkippedBecauseBackedUp, 1)
+	reason := fmt.Sprintf("requests queue of %s.%s backed up, request not sent", region, subRegion)
+	err := publishSyntheticResponse(record, region, subRegion, errorcode.NOTEXECUTED, reason)
+	if err != nil {
+		log.Printf("Error while publishing not executed response for check [%s]: %s\n", record.Record.CheckId, err.Error())
+	}
+}
+
+// handleExpiredRequestsWhileSchedulerIsRunning records a "not executed" response for the requests expired in the queues
+func handleExpiredRequestsWhileSchedulerIsRunning() {
+	if settings.GetSettInt(queuehelper.QUEUEREQUESTTTLMS) <= 0 || settings.GetSettDuration(SCHBACKPRESSUREREFRESHMS) <= 0 {
+		return
+	}
+	for {
+		time.Sleep(settings.GetSettDuration(SCHBACKPRESSUREREFRESHMS) * time.Millisecond)
+
+		// the dead letter queue is shared by all the scheduler instances, only one of them looks after it
+		if isLeader, _ := leaderElection.Leadership(); !isLeader {
+			continue
+		}
+		_, err := queuehelper.DrainDeadLetterQueue(handleExpiredRequest)
+		if err != nil {
+			log.Printf("Error while reading expired requests: %s\n", err.Error())
+		}
+	}
+}
+
+func handleExpiredRequest(body []byte) error {
+	var record queuehelper.CheckRecordQueued
+
+	err := json.Unmarshal(body, &record)
+	if err != nil {
+		// nothing we can do with it, no reason to keep it
+		log.Printf("Expired request discarded, unable to read it: %s\n", err.Error())
+		return nil
+	}
+	atomic.AddInt64(&jobsExpiredInQueue, 1)
+
+	// confirmations are not in flight, and a request could have been already handled by the in flight sweeper
+	inFlight, claimed, err := claimInFlight(record.RequestId)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return nil
+	}
+
+	reason := fmt.Sprintf("request RID [%s] expired in the requests queue of %s.%s", record.RequestId, inFlight.Region, inFlight.SubRegion)
+
+	return publishSyntheticResponse(record, inFlight.Region, inFlight.SubRegion, errorcode.NOTEXECUTED, reason)
+}
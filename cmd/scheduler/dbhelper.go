@@ -5,10 +5,13 @@ import (
 	"time"
 
 	"brainyping/pkg/dbhelper"
+	"brainyping/pkg/heartbeat"
+	"brainyping/pkg/initapp"
 	"brainyping/pkg/queuehelper"
 	"brainyping/pkg/utilities"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -26,19 +29,7 @@ func CountEnabledChecks() int64 {
 
 func RetrieveEnabledChecksToBeScheduled(ch chan dbhelper.CheckRecord) {
 	coll := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameChecks)
-	opts := options.Find().SetProjection(bson.D{
-		{"checkid", 1},
-		{"name", 1},
-		{"host", 1},
-		{"port", 1},
-		{"type", 1},
-		{"subtype", 1},
-		{"frequency", 1},
-		{"regions", 1},
-		{"regionseachtime", 1},
-		{"owneruid", 1},
-		{"startschedtimeunix", 1},
-	})
+	opts := options.Find().SetProjection(checksProjection())
 	cursor, err := coll.Find(nil, bson.M{"enabled": true}, opts)
 	if err != nil {
 		log.Fatalf("OOOUCH " + err.Error())
@@ -57,22 +48,199 @@ func RetrieveEnabledChecksToBeScheduled(ch chan dbhelper.CheckRecord) {
 	return
 }
 
-func saveRecordAsInFlight(record queuehelper.CheckRecordQueued) error {
+// checksProjection returns the fields of the checks needed by the scheduler (and sent to the workers)
+func checksProjection() bson.D {
+	return bson.D{
+		{"checkid", 1},
+		{"name", 1},
+		{"host", 1},
+		{"port", 1},
+		{"type", 1},
+		{"subtype", 1},
+		{"useragent", 1},
+		{"httpheaders", 1},
+		{"httpbody", 1},
+		{"httpstatuscodeok", 1},
+		{"responsestring", 1},
+		{"responsestringisregex", 1},
+		{"httpassertions", 1},
+		{"httpsteps", 1},
+		{"timeoutms", 1},
+		{"slowthresholdms", 1},
+		{"httpdontfollowredirects", 1},
+		{"httpmaxredirects", 1},
+		{"httpfailonhostchange", 1},
+		{"httpfailondowngrade", 1},
+		{"tlsexpirywarningdays", 1},
+		{"pingcount", 1},
+		{"pingintervalms", 1},
+		{"pingmaxlossperc", 1},
+		{"pingmaxlatencyms", 1},
+		{"dnsresolver", 1},
+		{"dnsexpectedanswers", 1},
+		{"mailstarttls", 1},
+		{"mailehlodomain", 1},
+		{"mailexpectedbanner", 1},
+		{"confirmregions", 1},
+		{"confirmquorum", 1},
+		{"frequency", 1},
+		{"frequencyunit", 1},
+		{"cronexpression", 1},
+		{"crontimezone", 1},
+		{"regions", 1},
+		{"regionsstrategy", 1},
+		{"regionseachtime", 1},
+		{"owneruid", 1},
+		{"startschedtimeunix", 1},
+		{"enabled", 1},
+		{"updatedunix", 1},
+	}
+}
+
+// retrieveChecksUpdatedSince returns the checks updated since the time passed, disabled ones included so they can be removed from the scheduler
+func retrieveChecksUpdatedSince(updatedUnix int64) ([]dbhelper.CheckRecord, error) {
+	var records []dbhelper.CheckRecord
+
+	coll := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameChecks)
+	cursor, err := coll.Find(nil, bson.M{"updatedunix": bson.M{"$gte": updatedUnix}}, options.Find().SetProjection(checksProjection()))
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(nil, &records)
+
+	return records, err
+}
+
+// retrieveEnabledCheckIds returns the ids of all the enabled checks, used to find the checks deleted
+func retrieveEnabledCheckIds() (map[string]bool, error) {
+	var record struct {
+		CheckId string `bson:"checkid"`
+	}
+	var checkIds = map[string]bool{}
+
+	coll := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameChecks)
+	cursor, err := coll.Find(nil, bson.M{"enabled": true}, options.Find().SetProjection(bson.D{{"checkid", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	for cursor.Next(nil) {
+		err = cursor.Decode(&record)
+		if err != nil {
+			return nil, err
+		}
+		checkIds[record.CheckId] = true
+	}
+
+	return checkIds, cursor.Err()
+}
+
+// retrieveActiveSchedulers returns the hostnames of the scheduler instances with a heartbeat since the time passed
+func retrieveActiveSchedulers(sinceUnix int64) ([]string, error) {
+	var record heartbeat.HeartBeatDBType
+	var hostNames []string
 
-	var recToSave struct {
-		CheckId           string `bson:"checkid"`
-		Rid               string `bson:"rid"`
-		InFlightSinceUnix int64  `bson:"inflightsinceunix"`
-		InFlightSince     string `bson:"inflightsince"`
+	coll := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameHeartbeats)
+	filter := bson.M{"approle": initapp.GetAppRole(), "lasthbunix": bson.M{"$gte": sinceUnix}}
+	cursor, err := coll.Find(nil, filter, options.Find().SetProjection(bson.D{{"hostname", 1}}))
+	if err != nil {
+		return nil, err
+	}
+	for cursor.Next(nil) {
+		err = cursor.Decode(&record)
+		if err != nil {
+			return nil, err
+		}
+		hostNames = append(hostNames, record.HostName)
 	}
 
+	return hostNames, cursor.Err()
+}
+
+type inFlightRecordType struct {
+	CheckId           string `bson:"checkid"`
+	Rid               string `bson:"rid"`
+	RunId             string `bson:"runid"`
+	RunRegions        int    `bson:"runregions"`
+	Region            string `bson:"region"`
+	SubRegion         string `bson:"subregion"`
+	InFlightSinceUnix int64  `bson:"inflightsinceunix"`
+	InFlightSince     string `bson:"inflightsince"`
+	FencingLease      string `bson:"fencinglease"`
+	FencingToken      int64  `bson:"fencingtoken"`
+	ScheduledUnix     int64  `bson:"scheduledunix"`
+	Requeues          int    `bson:"requeues"`
+}
+
+func saveRecordAsInFlight(record queuehelper.CheckRecordQueued, region string, subRegion string) error {
+
+	var recToSave inFlightRecordType
+
 	recToSave.Rid = record.RequestId
+	recToSave.RunId = record.RunId
+	recToSave.RunRegions = record.RunRegions
+	recToSave.Region = region
+	recToSave.SubRegion = subRegion
 	recToSave.CheckId = record.Record.CheckId
 	recToSave.InFlightSinceUnix = record.QueuedUnix
 	recToSave.InFlightSince = time.Unix(record.QueuedUnix, 0).Format(time.Stamp)
+	recToSave.FencingLease = record.FencingLease
+	recToSave.FencingToken = record.FencingToken
+	recToSave.ScheduledUnix = record.ScheduledUnix
+	recToSave.Requeues = record.InFlightRequeues
 
 	var recToSaveI interface{} = recToSave
 
 	return dbhelper.SaveRecord(dbhelper.GetClient(), dbhelper.GetDatabaseName(), dbhelper.TablenameChecksInFlight, recToSaveI, &options.InsertOneOptions{})
 
 }
+
+// updateRecordInFlightRegion records the region/subregion an in flight request has been re-routed to
+func updateRecordInFlightRegion(requestId string, region string, subRegion string) error {
+	update := bson.M{"$set": bson.M{"region": region, "subregion": subRegion}}
+	return dbhelper.UpdateRecord(dbhelper.GetClient(), dbhelper.GetDatabaseName(), dbhelper.TablenameChecksInFlight, bson.M{"rid": requestId}, update, options.Update())
+}
+
+// retrieveStaleInFlight returns the requests queued before the time passed and still waiting for a response
+func retrieveStaleInFlight(beforeUnix int64) ([]inFlightRecordType, error) {
+	var records []inFlightRecordType
+
+	coll := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameChecksInFlight)
+	cursor, err := coll.Find(nil, bson.M{"inflightsinceunix": bson.M{"$lt": beforeUnix}})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(nil, &records)
+
+	return records, err
+}
+
+// claimInFlight removes the in flight record and returns it, false if it was already gone (response arrived in the meantime)
+func claimInFlight(requestId string) (inFlightRecordType, bool, error) {
+	var record inFlightRecordType
+
+	err := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameChecksInFlight).FindOneAndDelete(nil, bson.M{"rid": requestId}).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+
+	return record, true, nil
+}
+
+// retrieveCheckById returns the check to schedule, false if the check doesn't exist or is not enabled anymore
+func retrieveCheckById(checkId string) (dbhelper.CheckRecord, bool, error) {
+	var record dbhelper.CheckRecord
+
+	coll := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameChecks)
+	err := coll.FindOne(nil, bson.M{"checkid": checkId, "enabled": true}, options.FindOne().SetProjection(checksProjection())).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+
+	return record, true, nil
+}
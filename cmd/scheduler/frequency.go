@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"brainyping/pkg/dbhelper"
+
+	"github.com/go-co-op/gocron"
+	"github.com/robfig/cron/v3"
+)
+
+// checks run every [frequency] [frequency unit], minutes if the unit is empty
+// when a cron expression is configured the frequency is ignored and the check runs following the expression in the timezone of the check
+const FREQUENCYUNITSECONDS = "SECONDS"
+const FREQUENCYUNITMINUTES = "MINUTES"
+const FREQUENCYUNITHOURS = "HOURS"
+
+// gocron uses the same timezone for all the cron jobs of a scheduler, cron checks in a timezone other than UTC get a scheduler
+// dedicated to their timezone. The key is the timezone name, the main scheduler (UTC) is not in the map
+var timezoneSchedulers = map[string]*gocron.Scheduler{}
+
+// validateSchedule makes sure the scheduler is able to schedule the check
+func validateSchedule(frequency int, frequencyUnit string, cronExpression string, cronTimezone string) error {
+	if cronExpression != "" {
+		location, err := time.LoadLocation(cronTimezone)
+		if err != nil {
+			return errors.New(fmt.Sprintf("cron timezone [%s] not valid: %s", cronTimezone, err.Error()))
+		}
+		_, err = cron.ParseStandard(fmt.Sprintf("CRON_TZ=%s %s", location.String(), cronExpression))
+		if err != nil {
+			return errors.New(fmt.Sprintf("cron expression [%s] not valid: %s", cronExpression, err.Error()))
+		}
+		return nil
+	}
+
+	if frequency <= 0 {
+		return errors.New(fmt.Sprintf("frequency [%d] not valid", frequency))
+	}
+	switch frequencyUnit {
+	case "", FREQUENCYUNITSECONDS, FREQUENCYUNITMINUTES, FREQUENCYUNITHOURS:
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("frequency unit [%s] not valid, expected %s, %s or %s", frequencyUnit, FREQUENCYUNITSECONDS, FREQUENCYUNITMINUTES, FREQUENCYUNITHOURS))
+}
+
+// schedulerForTimezone returns the scheduler to use for a cron check, started if the main scheduler is already running
+// the caller must hold schedulerJobsMutex
+func schedulerForTimezone(cronTimezone string) (*gocron.Scheduler, error) {
+	location, err := time.LoadLocation(cronTimezone)
+	if err != nil {
+		return nil, err
+	}
+	if location.String() == time.UTC.String() {
+		return scheduler, nil
+	}
+	if s, exists := timezoneSchedulers[location.String()]; exists {
+		return s, nil
+	}
+
+	s := gocron.NewScheduler(location)
+	s.TagsUnique()
+	if scheduler.IsRunning() {
+		s.StartAsync()
+	}
+	timezoneSchedulers[location.String()] = s
+
+	return s, nil
+}
+
+// everyWithUnit sets the interval of the job using the unit of the check
+func everyWithUnit(s *gocron.Scheduler, frequency int, frequencyUnit string) *gocron.Scheduler {
+	switch frequencyUnit {
+	case FREQUENCYUNITSECONDS:
+		return s.Every(frequency).Seconds()
+	case FREQUENCYUNITHOURS:
+		return s.Every(frequency).Hours()
+	default:
+		return s.Every(frequency).Minutes()
+	}
+}
+
+// frequencyInterval returns the time between two runs of a check not using a cron expression
+func frequencyInterval(frequency int, frequencyUnit string) time.Duration {
+	switch frequencyUnit {
+	case FREQUENCYUNITSECONDS:
+		return time.Duration(frequency) * time.Second
+	case FREQUENCYUNITHOURS:
+		return time.Duration(frequency) * time.Hour
+	default:
+		return time.Duration(frequency) * time.Minute
+	}
+}
+
+// plannedSlotUnix returns the time the run happening now was planned for, the last slot not after now
+// slots are StartSchedTimeUnix + n * frequency, or the activations of the cron expression. The difference between
+// the planned slot and the time the run is queued is the lag of the scheduler
+func plannedSlotUnix(record dbhelper.CheckRecord, now time.Time) int64 {
+	if record.CronExpression != "" {
+		location, err := time.LoadLocation(record.CronTimezone)
+		if err != nil {
+			return now.Unix()
+		}
+		schedule, err := cron.ParseStandard(fmt.Sprintf("CRON_TZ=%s %s", location.String(), record.CronExpression))
+		if err != nil {
+			return now.Unix()
+		}
+		// cron expressions have a granularity of one minute, the activation of the current minute is the planned slot
+		slot := schedule.Next(now.Truncate(time.Minute).Add(-time.Second))
+		if slot.After(now) {
+			return now.Unix()
+		}
+		return slot.Unix()
+	}
+
+	interval := int64(frequencyInterval(record.Frequency, record.FrequencyUnit) / time.Second)
+	if interval <= 0 || now.Unix() < record.StartSchedTimeUnix {
+		return record.StartSchedTimeUnix
+	}
+
+	return record.StartSchedTimeUnix + (now.Unix()-record.StartSchedTimeUnix)/interval*interval
+}
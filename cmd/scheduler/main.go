@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math/rand"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -13,6 +13,7 @@ import (
 	"brainyping/pkg/heartbeat"
 	"brainyping/pkg/initapp"
 	"brainyping/pkg/internalstatusmonitorapi"
+	"brainyping/pkg/leaderelection"
 	"brainyping/pkg/queuehelper"
 	"brainyping/pkg/settings"
 	_ "brainyping/pkg/settings"
@@ -25,9 +26,37 @@ import (
 var scheduler *gocron.Scheduler
 var jobsQueuedSinceBoot int64
 var jobsNotQueuedBecausePaused int64
+var jobsNotScheduledBecauseNotValid int64
+var jobsNotQueuedBecauseStandby int64
 var schedulerPaused bool // this is not interacting with the scheduler directly but preventing it to push new cheduled jobs in the queue to be processed
 
+type scheduledCheckType struct {
+	updatedUnix int64
+	scheduler   *gocron.Scheduler
+}
+
+// checks in the scheduler with their updated time, used to ignore changes already applied, and the scheduler running them
+// the gocron job builder is not safe for concurrent use so jobs are added/removed holding the mutex
+var scheduledChecks = map[string]scheduledCheckType{}
+var schedulerJobsMutex = sync.Mutex{}
+
 const SCHAPIPORT = "SCH_API_PORT"
+const SCHLEASEDURATIONMS = "SCH_LEASE_DURATION_MS"
+
+// heartbeats are also used to know which scheduler instances are alive when sharding is enabled
+const SCHHEARTBEATFREQUENCY = time.Second * 15
+
+// more schedulers can run at the same time, only the one holding the lease queues the checks
+// the others have the same jobs scheduled and are ready to take over as soon as the lease expires
+const SCHEDULERLEASENAME = "scheduler"
+
+var leaderElection *leaderelection.LeaderElectionType
+
+// with sharding each instance holds the lease of its own partition too, see fencingLease
+var shardElection *leaderelection.LeaderElectionType
+
+// used by the sweeper to recognise the requests queued by an instance replaced in the meantime
+var fencingValidator *leaderelection.FencingValidatorType
 
 func main() {
 	initapp.InitApp("SCHEDULER")
@@ -35,21 +64,48 @@ func main() {
 
 	// start the listener for internal status monitoring
 	internalstatusmonitorapi.StartListener(settings.GetSettStr(SCHAPIPORT), initapp.GetAppRole())
+	internalstatusmonitorapi.AddStatusInfo("publishing", publishingStatus)
 
 	// start the beating..
-	heartbeat.New(utilities.RetrieveHostName(), initapp.RetrieveHostNameFriendly(), initapp.GetAppRole(), "-", "-", time.Second*15, dbhelper.GetClient(), dbhelper.GetDatabaseName(), dbhelper.TablenameHeartbeats, settings.GetSettStr(SCHAPIPORT), utilities.RetrievePublicIP()).Start()
+	heartbeat.New(utilities.RetrieveHostName(), initapp.RetrieveHostNameFriendly(), initapp.GetAppRole(), "-", "-", SCHHEARTBEATFREQUENCY, dbhelper.GetClient(), dbhelper.GetDatabaseName(), dbhelper.TablenameHeartbeats, settings.GetSettStr(SCHAPIPORT), utilities.RetrievePublicIP()).Start()
+
+	// each process needs its own holder id, more schedulers could run on the same host
+	var err error
+	holderId := fmt.Sprintf("%s--%s", utilities.RetrieveHostName(), uuid.NewString())
+	leaseDuration := settings.GetSettDuration(SCHLEASEDURATIONMS) * time.Millisecond
+	// renewed 3 times per lease duration, a renewal can fail without losing the lease
+	renewInterval := leaseDuration / 3
+	leaderElection, err = leaderelection.New(SCHEDULERLEASENAME, holderId, leaseDuration, renewInterval, dbhelper.GetClient(), dbhelper.GetDatabaseName(), dbhelper.TablenameLeases)
+	utilities.FailOnError(err)
+	leaderElection.Start()
+	if shardingEnabled() {
+		shardElection, err = leaderelection.New(shardLeaseName(shardMemberId()), holderId, leaseDuration, renewInterval, dbhelper.GetClient(), dbhelper.GetDatabaseName(), dbhelper.TablenameLeases)
+		utilities.FailOnError(err)
+		shardElection.Start()
+	}
+	fencingValidator = leaderelection.NewFencingValidator(leaseDuration, dbhelper.GetClient(), dbhelper.GetDatabaseName(), dbhelper.TablenameLeases)
 
 	fmt.Println("SCHEDULER")
 	fmt.Printf("Boot time is %s\n", initapp.GetBootTime().Format(time.Stamp))
 
 	// count enabled checks to plan
+	// with no checks the scheduler keeps running, checks added later are picked up by the reload
 	count := CountEnabledChecks()
-	if count == 0 {
-		fmt.Println("No checks to plan, bye bye.... ")
-		return
-	}
-
 	fmt.Println(count, " checks with enabled status")
+	reloadStartUnix := time.Now().Unix()
+
+	// regions/subregions disabled don't receive new checks, changes are applied while the scheduler is running
+	loadEnabledSubRegions()
+	go refreshRegionsWhileSchedulerIsRunning()
+
+	// with sharding enabled only the checks of the partition of this instance are scheduled
+	if shardingEnabled() {
+		_, err := loadShardsMembers()
+		utilities.FailOnError(err)
+		shardsMutex.RLock()
+		fmt.Printf("Sharding enabled, scheduler instances %v\n", shardsMembers)
+		shardsMutex.RUnlock()
+	}
 
 	scheduler = gocron.NewScheduler(time.UTC)
 	// enforce uniqueness of tags that we are using as a way to retrieve a scheduled job later...
@@ -64,6 +120,14 @@ func main() {
 	startScheduler()
 	schedulerPaused = false
 
+	// keep the scheduler in sync with the checks collection
+	go reloadChecksWhileSchedulerIsRunning(reloadStartUnix)
+	go rebalanceShardsWhileSchedulerIsRunning()
+	go sweepInFlightWhileSchedulerIsRunning()
+	go monitorQueuesDepthWhileSchedulerIsRunning()
+	go handleExpiredRequestsWhileSchedulerIsRunning()
+	go replayOutboxWhileSchedulerIsRunning()
+
 	// done, show some statistics.... forever!
 	ShowMemoryStatsWhileSchedulerIsRunning()
 
@@ -73,6 +137,11 @@ func startScheduler() {
 	doneSignal := make(chan int)
 	go waitForSchedulerToStart(doneSignal)
 	scheduler.StartAsync()
+	schedulerJobsMutex.Lock()
+	for _, s := range timezoneSchedulers {
+		s.StartAsync()
+	}
+	schedulerJobsMutex.Unlock()
 	doneSignal <- 1 // this should stop the go routing waiting for the scheduler to start...
 	close(doneSignal)
 }
@@ -80,8 +149,6 @@ func startScheduler() {
 func scheduleChecks() {
 	var recScheduledTotal int64
 	var record dbhelper.CheckRecord
-	var recordQueued queuehelper.CheckRecordQueued
-	var err error
 	var printLine = func(rec int64, memAlloc string) {
 		fmt.Printf("Checks scheduled %d (mem. %s)            \r", rec, memAlloc)
 	}
@@ -91,11 +158,17 @@ func scheduleChecks() {
 	go RetrieveEnabledChecksToBeScheduled(chRecords)
 
 	for record = range chRecords {
+		if !ownsCheck(record.CheckId) {
+			continue
+		}
+		// a check with a schedule not valid is skipped, it shouldn't stop all the others from being scheduled
+		err := scheduleCheck(record)
+		if err != nil {
+			atomic.AddInt64(&jobsNotScheduledBecauseNotValid, 1)
+			log.Println(err.Error())
+			continue
+		}
 		recScheduledTotal++
-		// add start time to the record to have a point of reference for future checks (and be able to reference a planned scheduled time instead of the time the check occurs)
-		recordQueued = queuehelper.CheckRecordQueued{Record: record}
-		_, err = scheduler.Every(record.Frequency).Minute().StartAt(time.Unix(record.StartSchedTimeUnix, 0)).Tag(record.CheckId).Do(queue, recordQueued)
-		utilities.FailOnError(err)
 		printLine(recScheduledTotal, utilities.GetMemoryStats("MB")["AllocUnit"])
 
 	} // end ch range
@@ -103,6 +176,54 @@ func scheduleChecks() {
 
 }
 
+// scheduleCheck adds the job of the check to the scheduler, the check id is the (unique) tag used to find the job later
+func scheduleCheck(record dbhelper.CheckRecord) error {
+	var recordQueued queuehelper.CheckRecordQueued
+	var checkScheduler = scheduler
+	var err error
+
+	err = validateSchedule(record.Frequency, record.FrequencyUnit, record.CronExpression, record.CronTimezone)
+	if err != nil {
+		return errors.New(fmt.Sprintf("check [%s] schedule not valid: %s", record.CheckId, err.Error()))
+	}
+
+	schedulerJobsMutex.Lock()
+	defer schedulerJobsMutex.Unlock()
+
+	// add start time to the record to have a point of reference for future checks (and be able to reference a planned scheduled time instead of the time the check occurs)
+	recordQueued = queuehelper.CheckRecordQueued{Record: record}
+	if record.CronExpression != "" {
+		checkScheduler, err = schedulerForTimezone(record.CronTimezone)
+		if err != nil {
+			return err
+		}
+		_, err = checkScheduler.Cron(record.CronExpression).Tag(record.CheckId).Do(queue, recordQueued)
+	} else {
+		_, err = everyWithUnit(checkScheduler, record.Frequency, record.FrequencyUnit).StartAt(time.Unix(record.StartSchedTimeUnix, 0)).Tag(record.CheckId).Do(queue, recordQueued)
+	}
+	if err != nil {
+		return err
+	}
+	scheduledChecks[record.CheckId] = scheduledCheckType{updatedUnix: record.UpdatedUnix, scheduler: checkScheduler}
+
+	return nil
+}
+
+// unscheduleCheck removes the job of the check from the scheduler, if any
+func unscheduleCheck(checkId string) bool {
+	schedulerJobsMutex.Lock()
+	defer schedulerJobsMutex.Unlock()
+
+	scheduled, exists := scheduledChecks[checkId]
+	if !exists {
+		return false
+	}
+	delete(scheduledChecks, checkId)
+	_ = scheduled.scheduler.RemoveByTag(checkId)
+
+	return true
+}
+
 func waitForSchedulerToStart(doneSignal <-chan int) {
 	var startedWaiting time.Time = time.Now()
 	var spinner = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
@@ -127,42 +248,85 @@ func queue(record queuehelper.CheckRecordQueued) {
 		atomic.AddInt64(&jobsNotQueuedBecausePaused, 1)
 		return
 	}
+	fencingLeaseName, fencingToken, holds := fencingLease()
+	if !holds {
+		atomic.AddInt64(&jobsNotQueuedBecauseStandby, 1)
+		return
+	}
 	atomic.AddInt64(&jobsQueuedSinceBoot, 1)
+	// the lease and its token identify the instance that queued the request, workers refuse the requests with a token older
+	// than the current token of the lease queued after the lease changed holder, they have been queued by an instance already replaced
+	record.FencingLease = fencingLeaseName
+	record.FencingToken = fencingToken
+	// all the requests sent for this run share the same run id, so the responses of the different regions can be grouped
+	record.RunId = fmt.Sprintf("%d--%s", time.Now().UnixNano(), uuid.NewString())
+	now := time.Now()
+	record.QueuedUnix = now.Unix()
+	// the slot the run was planned for, it's earlier than the queued time when the scheduler is lagging
+	record.ScheduledUnix = plannedSlotUnix(record.Record, now)
+	// TODO SEND THE SCHEDULED EVENT ALSO TO THE SCHEDULE PLAN...?
+
+	// if there are no regions configured (or all of them are disabled) ignore the request... even if it shouldn't be arrived here...
+	// todo LOG?
+	regions := selectRegions(record.Record.CheckId, enabledRegionsOnly(record.Record.Regions), record.Record.RegionsStrategy, record.Record.RegionsEachTime)
+	if len(regions) == 0 {
+		return
+	}
+	// the status monitor needs to know how many responses to expect for the run
+	record.RunRegions = len(regions)
+
+	for _, region := range regions {
+		queueWithBackpressure(record, region[0], region[1])
+	}
+
+}
+
+// fencingLease returns the lease the requests are queued under with its fencing token, false if the lease is not held.
+// Without sharding only the leader queues the checks. With sharding each instance queues the checks of its own partition
+// under the lease of its shard: only one process per shard member queues, and a process restarted with the same member id
+// gets a new token so the requests of the previous process are refused
+func fencingLease() (string, int64, bool) {
+	election := leaderElection
+	if shardingEnabled() {
+		election = shardElection
+	}
+	holds, fencingToken := election.Leadership()
+
+	return election.GetLeaseName(), fencingToken, holds
+}
+
+// queueForRegion publishes one request of the run to the region/subregion
+func queueForRegion(record queuehelper.CheckRecordQueued, region string, subRegion string) {
 	record.RequestId = fmt.Sprintf("%d--%s", time.Now().UnixNano(), uuid.NewString())
-	record.QueuedUnix = time.Now().Unix()
-	record.ScheduledUnix = record.QueuedUnix // use the same time as the queued time, we don't have a better alternative right now.
 	var recordJson, err = json.Marshal(record)
 	if err != nil {
-		fmt.Println("🔴")
-		log.Fatal(err)
+		atomic.AddInt64(&publishDroppedNotValid, 1)
+		log.Printf("Request for check [%s] dropped, unable to prepare it: %s\n", record.Record.CheckId, err.Error())
+		return
 	}
-	// TODO SEND THE SCHEDULED EVENT ALSO TO THE SCHEDULE PLAN...?
 
-	// if there are no regions configured ignore the request... even if it shouldn't be arrived here...
-	// todo LOG?
-	numOfRegions := len(record.Record.Regions)
-	if numOfRegions == 0 {
+	// requests already waiting in the outbox go first, the broker is probably still not reachable anyway
+	if outboxLen() > 0 {
+		addToOutbox(outboxItemType{record: record, region: region, subRegion: subRegion, body: recordJson})
 		return
 	}
 
-	// let's pick a random region to send the request to....
-	randomRegionId := rand.Intn(numOfRegions)
-
 	// for the moment we queue the whole record scheduled,
 	// maybe later down the line we want to slim down...or enrich?
-	err = PublishRequestForNewCheck(recordJson, record.Record.Regions[randomRegionId][0], record.Record.Regions[randomRegionId][1])
+	// the job doesn't wait for the broker, a request not published is retried by the outbox replay
+	err = PublishRequestForNewCheck(recordJson, region, subRegion)
 	if err != nil {
-		// TODO MAYBE WE DON'T WANT TO DIE BUT LOG AND TRY TO CONTINUE?
-		utilities.FailOnError(errors.New(fmt.Sprintf("Error while queueing record in queue %s.%s. Original error: %s", record.Record.Regions[randomRegionId][0], record.Record.Regions[randomRegionId][1], err)))
+		log.Printf("Error while queueing request in queue %s.%s, request kept in the outbox: %s\n", region, subRegion, err.Error())
+		addToOutbox(outboxItemType{record: record, region: region, subRegion: subRegion, body: recordJson})
+		return
 	}
 
-	err = saveRecordAsInFlight(record)
+	err = saveRecordAsInFlight(record, region, subRegion)
 	if err != nil {
 		// TODO LOG SOMEWHERE... FOR THE MOMENT SCREAM A LITTLE BIT...
 		// WE DON'T WANT TO KILL THE SCHEDULER FOR THIS ERROR....
 		fmt.Printf("\n\nERROR WHILE SAVING RECORD IN FLIGH\n\nRID %s\n%d\n%s\n\n", record.RequestId, record.ScheduledUnix, err.Error())
 	}
-
 }
 
 func ShowMemoryStatsWhileSchedulerIsRunning() {
@@ -174,9 +338,34 @@ func ShowMemoryStatsWhileSchedulerIsRunning() {
 		} else {
 			fmt.Println("SCHEDULER IS ACTIVE 🟢")
 		}
-		fmt.Printf("JOBS IN SCHEDULER %d JOBS QUEUED SO FAR %d MALLOC %s GC %s   (Uptime %s)",
-			scheduler.Len(),
+		if isLeader, fencingToken := leaderElection.Leadership(); isLeader {
+			fmt.Printf("SCHEDULER IS LEADER 👑 - FENCING TOKEN %d\n", fencingToken)
+		} else {
+			fmt.Printf("SCHEDULER IS STANDBY 💤 - JOBS NOT QUEUED %d\n", atomic.LoadInt64(&jobsNotQueuedBecauseStandby))
+		}
+		if shardingEnabled() {
+			shardsMutex.RLock()
+			fmt.Printf("SHARDS %v - JOBS MOVED TO OTHER SHARDS %d\n", shardsMembers, atomic.LoadInt64(&jobsMovedToOtherShards))
+			shardsMutex.RUnlock()
+		}
+		fmt.Printf("BACKPRESSURE SKIPPED %d REROUTED %d EXPIRED IN QUEUE %d\n",
+			atomic.LoadInt64(&jobsSkippedBecauseBackedUp),
+			atomic.LoadInt64(&jobsReroutedBecauseBackedUp),
+			atomic.LoadInt64(&jobsExpiredInQueue))
+		fmt.Printf("OUTBOX WAITING %d REPLAYED %d DROPPED %d PUBLISH RETRIES %d\n",
+			outboxLen(),
+			atomic.LoadInt64(&outboxReplayed),
+			atomic.LoadInt64(&publishDroppedNotValid)+atomic.LoadInt64(&publishDroppedOutboxFull)+atomic.LoadInt64(&publishDroppedExpired),
+			atomic.LoadInt64(&publishRetries))
+		if losses := inFlightLossesSummary(); losses != "" {
+			fmt.Printf("LOST IN FLIGHT %s\n", losses)
+		}
+		fmt.Printf("JOBS IN SCHEDULER %d JOBS QUEUED SO FAR %d JOBS RELOADED %d JOBS REMOVED %d NOT VALID %d MALLOC %s GC %s   (Uptime %s)",
+			scheduledJobsCount(),
 			jobsQueuedSinceBoot,
+			atomic.LoadInt64(&jobsReloaded),
+			atomic.LoadInt64(&jobsRemoved),
+			atomic.LoadInt64(&jobsNotScheduledBecauseNotValid),
 			memoryStats["AllocUnit"],
 			memoryStats["NumGC"],
 			time.Since(initapp.GetBootTime())/time.Second*time.Second)
@@ -184,3 +373,10 @@ func ShowMemoryStatsWhileSchedulerIsRunning() {
 		time.Sleep(time.Second * 1)
 	}
 }
+
+func scheduledJobsCount() int {
+	schedulerJobsMutex.Lock()
+	defer schedulerJobsMutex.Unlock()
+
+	return len(scheduledChecks)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"brainyping/pkg/queuehelper"
+	"brainyping/pkg/settings"
+)
+
+// a publish failure doesn't stop the scheduler: the request is kept in a bounded outbox and published again as soon as the broker is back.
+// The scheduler jobs never wait for the broker, the outbox replay is the one retrying with an exponential backoff.
+// When the outbox is full the oldest requests are dropped, they are the least useful anyway.
+// Without the replay nobody would ever empty the outbox, disabling the replay disables the outbox too.
+// Only the instance holding the lease the requests were queued under publishes them, a scheduler on standby drops them
+
+const SCHPUBLISHRETRIES = "SCH_PUBLISH_RETRIES"
+const SCHPUBLISHBACKOFFMS = "SCH_PUBLISH_BACKOFF_MS"
+const SCHOUTBOXSIZE = "SCH_OUTBOX_SIZE"
+const SCHOUTBOXREPLAYMS = "SCH_OUTBOX_REPLAY_MS"
+
+type outboxItemType struct {
+	record    queuehelper.CheckRecordQueued
+	region    string
+	subRegion string
+	body      []byte
+}
+
+var outbox []outboxItemType
+var outboxMutex = sync.Mutex{}
+
+var publishRetries int64
+var publishDroppedNotValid int64
+var publishDroppedOutboxFull int64
+var publishDroppedExpired int64
+var publishDroppedNotLeader int64
+var outboxReplayed int64
+
+func outboxLen() int {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+
+	return len(outbox)
+}
+
+func addToOutbox(item outboxItemType) {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+
+	if len(outbox) >= outboxSize() {
+		if len(outbox) == 0 {
+			// outbox disabled
+			atomic.AddInt64(&publishDroppedOutboxFull, 1)
+			return
+		}
+		outbox = outbox[1:]
+		atomic.AddInt64(&publishDroppedOutboxFull, 1)
+	}
+	outbox = append(outbox, item)
+}
+
+// outboxSize returns how many requests the outbox can keep, 0 if the outbox is disabled
+func outboxSize() int {
+	if settings.GetSettDuration(SCHOUTBOXREPLAYMS) <= 0 {
+		return 0
+	}
+
+	return settings.GetSettInt(SCHOUTBOXSIZE)
+}
+
+// replayOutboxWhileSchedulerIsRunning publishes the requests in the outbox, in the order they were queued
+// after a failure the replay is attempted again sooner, with a backoff doubling at each retry, before going back to the usual pace
+func replayOutboxWhileSchedulerIsRunning() {
+	var failures int
+
+	if settings.GetSettDuration(SCHOUTBOXREPLAYMS) <= 0 {
+		log.Println("Outbox replay disabled, requests not published will be lost")
+		return
+	}
+	for {
+		time.Sleep(replayDelay(failures))
+		err := replayOutboxIfHoldingTheLease()
+		if err != nil {
+			failures++
+			log.Printf("Outbox replay stopped, %d requests waiting: %s\n", outboxLen(), err.Error())
+			continue
+		}
+		failures = 0
+	}
+}
+
+// replayDelay returns how long to wait before the next replay, given the replays failed in a row
+func replayDelay(failures int) time.Duration {
+	if failures == 0 || failures > settings.GetSettInt(SCHPUBLISHRETRIES) {
+		return settings.GetSettDuration(SCHOUTBOXREPLAYMS) * time.Millisecond
+	}
+
+	return settings.GetSettDuration(SCHPUBLISHBACKOFFMS) * time.Millisecond << (failures - 1)
+}
+
+// replayOutboxIfHoldingTheLease replays the outbox only if the lease is still held, otherwise the requests are dropped:
+// the instance that took over is queueing the same checks
+func replayOutboxIfHoldingTheLease() error {
+	_, fencingToken, holds := fencingLease()
+	if !holds {
+		outboxMutex.Lock()
+		atomic.AddInt64(&publishDroppedNotLeader, int64(len(outbox)))
+		outbox = nil
+		outboxMutex.Unlock()
+		return nil
+	}
+
+	return replayOutbox(fencingToken)
+}
+
+// replayOutbox publishes the requests in the outbox until it is empty, it stops at the first request that can't be published
+// requests queued under a fencing token other than the current one are dropped, the lease has been held by another instance meanwhile
+func replayOutbox(fencingToken int64) error {
+	for {
+		outboxMutex.Lock()
+		if len(outbox) == 0 {
+			outboxMutex.Unlock()
+			return nil
+		}
+		item := outbox[0]
+		outboxMutex.Unlock()
+
+		// requests older than the ttl would be dead-lettered as soon as they arrive in the queue
+		ttl := settings.GetSettInt(queuehelper.QUEUEREQUESTTTLMS)
+		expired := ttl > 0 && time.Since(time.Unix(item.record.QueuedUnix, 0)) > time.Duration(ttl)*time.Millisecond
+		fenced := item.record.FencingToken != fencingToken
+
+		if !expired && !fenced {
+			atomic.AddInt64(&publishRetries, 1)
+			err := PublishRequestForNewCheck(item.body, item.region, item.subRegion)
+			if err != nil {
+				// still not reachable, try again later
+				return err
+			}
+		}
+
+		outboxMutex.Lock()
+		// the item could have been dropped while publishing if the outbox was full
+		if len(outbox) > 0 && outbox[0].record.RequestId == item.record.RequestId {
+			outbox = outbox[1:]
+		}
+		outboxMutex.Unlock()
+
+		if expired {
+			atomic.AddInt64(&publishDroppedExpired, 1)
+			continue
+		}
+		if fenced {
+			atomic.AddInt64(&publishDroppedNotLeader, 1)
+			continue
+		}
+		atomic.AddInt64(&outboxReplayed, 1)
+		err := saveRecordAsInFlight(item.record, item.region, item.subRegion)
+		if err != nil {
+			log.Printf("Error while saving in flight record RID [%s]: %s\n", item.record.RequestId, err.Error())
+		}
+	}
+}
+
+// publishingStatus is exposed by the status api
+func publishingStatus() interface{} {
+	return map[string]int64{
+		"retries":             atomic.LoadInt64(&publishRetries),
+		"droppedNotValid":     atomic.LoadInt64(&publishDroppedNotValid),
+		"droppedOutboxFull":   atomic.LoadInt64(&publishDroppedOutboxFull),
+		"droppedExpired":      atomic.LoadInt64(&publishDroppedExpired),
+		"droppedNotLeader":    atomic.LoadInt64(&publishDroppedNotLeader),
+		"outboxReplayed":      atomic.LoadInt64(&outboxReplayed),
+		"outboxWaiting":       int64(outboxLen()),
+		"jobsQueuedSinceBoot": atomic.LoadInt64(&jobsQueuedSinceBoot),
+	}
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"brainyping/pkg/queuehelper"
+	"brainyping/pkg/settings"
 )
 
 func PublishRequestForNewCheck(body []byte, region string, subRegion string) error {
 	// please note that the messages are published in a durable way, this is probably more useful in dev phase than prod
 	// we should probably create a flag to accomodate this... 🤠.....
-	return queuehelper.PublishToTopicExchange(queuehelper.BuildRequestsQueueBindingKey(region, subRegion), body)
+	return queuehelper.PublishRequestToTopicExchange(queuehelper.BuildRequestsQueueBindingKey(region, subRegion), body)
+}
+
+// PublishResponseForLostRequest sends the response of a request that never came back, as it was sent by a worker
+func PublishResponseForLostRequest(body []byte) error {
+	return queuehelper.PublishToQueueDirectly(settings.GetSettStr(queuehelper.QUEUENAMERESPONSE), body)
 }
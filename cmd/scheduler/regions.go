@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"brainyping/pkg/queuehelper"
+	"brainyping/pkg/settings"
+	"brainyping/pkg/utilities"
+)
+
+// strategies used to pick the regions a check is sent to on each run
+const REGIONSSTRATEGYRANDOM = "RANDOM"
+const REGIONSSTRATEGYROUNDROBIN = "ROUNDROBIN"
+const REGIONSSTRATEGYALL = "ALL"
+
+const SCHREGIONSREFRESHMS = "SCH_REGIONS_REFRESH_MS"
+
+// region.subregion keys of the subregions that can receive new checks, refreshed while the scheduler is running
+var enabledSubRegions = map[string]bool{}
+var enabledSubRegionsMutex = sync.RWMutex{}
+
+// position of the next region to use for the checks using the round-robin strategy, by check id
+var roundRobinPositions = map[string]int{}
+var roundRobinPositionsMutex = sync.Mutex{}
+
+// selectRegions returns the regions/subregions the check has to be sent to for this run
+// RANDOM and ROUNDROBIN pick regionseachtime regions (1 if empty), ALL picks every region configured in the check
+// an unknown strategy is treated as RANDOM, it is the behaviour the checks had before strategies were introduced
+func selectRegions(checkId string, regions [][]string, strategy string, regionsEachTime int) [][]string {
+	var selected [][]string
+
+	if len(regions) == 0 {
+		return nil
+	}
+	if regionsEachTime <= 0 {
+		regionsEachTime = 1
+	}
+	if regionsEachTime > len(regions) {
+		regionsEachTime = len(regions)
+	}
+
+	switch strategy {
+	case REGIONSSTRATEGYALL:
+		selected = regions
+	case REGIONSSTRATEGYROUNDROBIN:
+		roundRobinPositionsMutex.Lock()
+		position := roundRobinPositions[checkId]
+		roundRobinPositions[checkId] = (position + regionsEachTime) % len(regions)
+		roundRobinPositionsMutex.Unlock()
+		for i := 0; i < regionsEachTime; i++ {
+			selected = append(selected, regions[(position+i)%len(regions)])
+		}
+	default:
+		for _, i := range rand.Perm(len(regions))[:regionsEachTime] {
+			selected = append(selected, regions[i])
+		}
+	}
+
+	return selected
+}
+
+func loadEnabledSubRegions() {
+	regions, err := settings.GetRegionsList()
+	utilities.FailOnError(err)
+
+	enabledSubRegionsMutex.Lock()
+	enabledSubRegions = settings.EnabledSubRegions(regions)
+	enabledSubRegionsMutex.Unlock()
+}
+
+// enabledRegionsOnly removes from the regions of the check the ones disabled
+func enabledRegionsOnly(regions [][]string) [][]string {
+	var enabled [][]string
+
+	enabledSubRegionsMutex.RLock()
+	defer enabledSubRegionsMutex.RUnlock()
+
+	for _, r := range regions {
+		if len(r) >= 2 && enabledSubRegions[settings.SubRegionKey(r[0], r[1])] {
+			enabled = append(enabled, r)
+		}
+	}
+
+	return enabled
+}
+
+// refreshRegionsWhileSchedulerIsRunning reloads the regions list, so regions/subregions can be enabled or disabled (to drain them for maintenance)
+// without restarting the scheduler. Requests waiting in the queue of a region just disabled are re-routed to the other regions of the check
+func refreshRegionsWhileSchedulerIsRunning() {
+	if settings.GetSettDuration(SCHREGIONSREFRESHMS) <= 0 {
+		log.Println("Regions refresh disabled, regions changes will be applied at the next boot")
+		return
+	}
+	for {
+		time.Sleep(settings.GetSettDuration(SCHREGIONSREFRESHMS) * time.Millisecond)
+
+		regions, err := settings.ReloadRegionsList()
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		newEnabled := settings.EnabledSubRegions(regions)
+
+		enabledSubRegionsMutex.Lock()
+		previouslyEnabled := enabledSubRegions
+		enabledSubRegions = newEnabled
+		enabledSubRegionsMutex.Unlock()
+
+		for key := range newEnabled {
+			if !previouslyEnabled[key] {
+				log.Printf("Subregion %s enabled\n", key)
+				// the queue of the subregion could have never been declared by this scheduler
+				err = queuehelper.RefreshRequestsQueues()
+				if err != nil {
+					log.Printf("Error while declaring requests queues: %s\n", err.Error())
+				}
+				break
+			}
+		}
+
+		for _, r := range regions {
+			for _, sr := range r.SubRegions {
+				key := settings.SubRegionKey(r.Id, sr.Id)
+				if previouslyEnabled[key] && !newEnabled[key] {
+					log.Printf("Subregion %s disabled\n", key)
+					// standby schedulers don't queue requests, re-routing is a job for the leader
+					if isLeader, _ := leaderElection.Leadership(); !isLeader {
+						continue
+					}
+					rerouteRequestsQueue(r.Id, sr.Id)
+				}
+			}
+		}
+	}
+}
+
+// rerouteRequestsQueue moves the requests not yet picked up by the workers of a disabled subregion to another region of the check
+// requests already picked up by a worker are left alone, the response will arrive as usual
+func rerouteRequestsQueue(region string, subRegion string) {
+	rerouted, err := queuehelper.DrainRequestsQueue(region, subRegion, func(body []byte) error {
+		var record queuehelper.CheckRecordQueued
+
+		err := json.Unmarshal(body, &record)
+		if err != nil {
+			return err
+		}
+		candidates := enabledRegionsOnly(record.Record.Regions)
+		if len(candidates) == 0 {
+			return errors.New(fmt.Sprintf("no enabled region available for check [%s] RID [%s]", record.Record.CheckId, record.RequestId))
+		}
+		target := candidates[rand.Intn(len(candidates))]
+
+		err = PublishRequestForNewCheck(body, target[0], target[1])
+		if err != nil {
+			return err
+		}
+		err = updateRecordInFlightRegion(record.RequestId, target[0], target[1])
+		if err != nil {
+			// the request has been re-routed anyway, the in flight record will just show the old region
+			log.Printf("Error while updating in flight record RID [%s]: %s\n", record.RequestId, err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error while re-routing requests of %s.%s (%d re-routed): %s\n", region, subRegion, rerouted, err.Error())
+		return
+	}
+	log.Printf("%d requests of %s.%s re-routed\n", rerouted, region, subRegion)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"brainyping/pkg/dbhelper"
+	"brainyping/pkg/settings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Checks added, changed, disabled or deleted while the scheduler is running are applied without a restart.
+// The checks collection is watched with a change stream, if change streams are not available (they need a replica set)
+// the collection is polled looking for checks with a recent updated time. Deleted checks can't be found by polling,
+// so each poll also compares the jobs in the scheduler with the enabled checks.
+
+const SCHCHECKSRELOADMS = "SCH_CHECKS_RELOAD_MS"
+
+var jobsReloaded int64
+var jobsRemoved int64
+
+func reloadChecksWhileSchedulerIsRunning(sinceUnix int64) {
+	if settings.GetSettDuration(SCHCHECKSRELOADMS) <= 0 {
+		log.Println("Checks reload disabled, checks changes will be applied at the next boot")
+		return
+	}
+
+	err := watchChecksChangeStream(sinceUnix)
+	log.Printf("Checks change stream not available (%s), polling the checks collection\n", err.Error())
+
+	pollChecksChanges(sinceUnix)
+}
+
+// watchChecksChangeStream applies the changes received from the change stream, it returns only if the stream fails
+func watchChecksChangeStream(sinceUnix int64) error {
+	var event struct {
+		OperationType string               `bson:"operationType"`
+		FullDocument  dbhelper.CheckRecord `bson:"fullDocument"`
+	}
+
+	coll := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameChecks)
+	stream, err := coll.Watch(context.Background(), mongo.Pipeline{}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	// changes happened while the checks were loaded at boot are not in the stream
+	records, err := retrieveChecksUpdatedSince(sinceUnix)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		applyCheckChange(record)
+	}
+
+	for stream.Next(context.Background()) {
+		event.FullDocument = dbhelper.CheckRecord{}
+		err = stream.Decode(&event)
+		if err != nil {
+			return err
+		}
+		switch event.OperationType {
+		case "insert", "update", "replace":
+			// the full document is empty if the check has been deleted after the update
+			if event.FullDocument.CheckId != "" {
+				applyCheckChange(event.FullDocument)
+			}
+		case "delete":
+			// the event only has the _id of the check, the scheduler knows checks by check id
+			removeDeletedChecks()
+		}
+	}
+
+	if stream.Err() != nil {
+		return stream.Err()
+	}
+	return errors.New("change stream closed")
+}
+
+func pollChecksChanges(sinceUnix int64) {
+	for {
+		time.Sleep(settings.GetSettDuration(SCHCHECKSRELOADMS) * time.Millisecond)
+
+		pollStartUnix := time.Now().Unix()
+		records, err := retrieveChecksUpdatedSince(sinceUnix)
+		if err != nil {
+			log.Printf("Error while polling checks changes: %s\n", err.Error())
+			continue
+		}
+		for _, record := range records {
+			applyCheckChange(record)
+		}
+		removeDeletedChecks()
+
+		// the same second is read again on the next poll, changes already applied are ignored
+		sinceUnix = pollStartUnix
+	}
+}
+
+// applyCheckChange adds, reschedules or removes the job of the check
+func applyCheckChange(record dbhelper.CheckRecord) {
+	if !ownsCheck(record.CheckId) {
+		// the check belongs to another instance, it could have been moved while the change was on its way
+		unscheduleCheck(record.CheckId)
+		return
+	}
+	if !record.Enabled {
+		if unscheduleCheck(record.CheckId) {
+			atomic.AddInt64(&jobsRemoved, 1)
+			log.Printf("Check [%s] disabled, removed from the scheduler\n", record.CheckId)
+		}
+		return
+	}
+
+	schedulerJobsMutex.Lock()
+	scheduled, exists := scheduledChecks[record.CheckId]
+	schedulerJobsMutex.Unlock()
+	if exists && scheduled.updatedUnix == record.UpdatedUnix {
+		return
+	}
+
+	// the record is a parameter of the job so any change requires the job to be created again
+	unscheduleCheck(record.CheckId)
+	err := scheduleCheck(record)
+	if err != nil {
+		atomic.AddInt64(&jobsNotScheduledBecauseNotValid, 1)
+		log.Printf("Error while scheduling check [%s]: %s\n", record.CheckId, err.Error())
+		return
+	}
+	atomic.AddInt64(&jobsReloaded, 1)
+	log.Printf("Check [%s] scheduled again after a change\n", record.CheckId)
+}
+
+// removeDeletedChecks removes the jobs of the checks not enabled anymore in the checks collection
+func removeDeletedChecks() {
+	var toRemove []string
+
+	enabled, err := retrieveEnabledCheckIds()
+	if err != nil {
+		log.Printf("Error while retrieving enabled checks: %s\n", err.Error())
+		return
+	}
+
+	schedulerJobsMutex.Lock()
+	for checkId := range scheduledChecks {
+		if !enabled[checkId] {
+			toRemove = append(toRemove, checkId)
+		}
+	}
+	schedulerJobsMutex.Unlock()
+
+	for _, checkId := range toRemove {
+		if unscheduleCheck(checkId) {
+			atomic.AddInt64(&jobsRemoved, 1)
+			log.Printf("Check [%s] not found, removed from the scheduler\n", checkId)
+		}
+	}
+}
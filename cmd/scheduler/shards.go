@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"brainyping/pkg/dbhelper"
+	"brainyping/pkg/settings"
+	"brainyping/pkg/utilities"
+)
+
+// with sharding enabled each scheduler instance schedules only a partition of the checks, instead of all of them
+// checks are assigned to the instances alive (the ones with a recent heartbeat) using consistent hashing of the check id,
+// so when an instance joins or leaves only the checks of its partition move to/from the other instances.
+// Without sharding every instance schedules all the checks and only the leader queues them
+
+const SCHSHARDINGENABLED = "SCH_SHARDING_ENABLED"
+const SCHSHARDSREFRESHMS = "SCH_SHARDS_REFRESH_MS"
+
+// points of each instance in the ring, more points spread the checks more evenly
+const SHARDSVIRTUALNODES = 256
+
+// an instance that missed this many heartbeats is considered gone and its checks are taken over by the others
+const SHARDSMISSEDHEARTBEATS = 3
+
+type shardsRingType struct {
+	points  []uint32
+	members map[uint32]string
+}
+
+var shardsRing = shardsRingType{}
+var shardsMembers []string
+var shardsMutex = sync.RWMutex{}
+var jobsMovedToOtherShards int64
+
+func shardingEnabled() bool {
+	return settings.GetSettInt(SCHSHARDINGENABLED) == 1
+}
+
+// shardMemberId is the id of this instance in the ring, it is the hostname used by the heartbeat
+func shardMemberId() string {
+	return utilities.RetrieveHostName()
+}
+
+// shardsHash returns the position in the ring, crc32/fnv don't spread similar strings (RECID-1, RECID-2...) evenly enough
+func shardsHash(key string) uint32 {
+	digest := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint32(digest[:4])
+}
+
+// shardLeaseName is the lease of the partition of the member, held by the process queueing the checks of the partition
+func shardLeaseName(memberId string) string {
+	return fmt.Sprintf("%s.%s", SCHEDULERLEASENAME, memberId)
+}
+
+func newShardsRing(members []string) shardsRingType {
+	ring := shardsRingType{members: map[uint32]string{}}
+
+	for _, member := range members {
+		for i := 0; i < SHARDSVIRTUALNODES; i++ {
+			point := shardsHash(fmt.Sprintf("%s#%d", member, i))
+			ring.points = append(ring.points, point)
+			ring.members[point] = member
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+
+	return ring
+}
+
+// owner returns the instance the check belongs to, the first point of the ring after the hash of the check id
+func (ring shardsRingType) owner(checkId string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	hash := shardsHash(checkId)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+
+	return ring.members[ring.points[i]]
+}
+
+// ownsCheck returns true if the check belongs to the partition of this instance, always true without sharding
+func ownsCheck(checkId string) bool {
+	if !shardingEnabled() {
+		return true
+	}
+	shardsMutex.RLock()
+	defer shardsMutex.RUnlock()
+
+	return shardsRing.owner(checkId) == shardMemberId()
+}
+
+// loadShardsMembers rebuilds the ring with the instances alive, returns true if the members changed
+func loadShardsMembers() (bool, error) {
+	sinceUnix := time.Now().Add(-SCHHEARTBEATFREQUENCY * SHARDSMISSEDHEARTBEATS).Unix()
+	members, err := retrieveActiveSchedulers(sinceUnix)
+	if err != nil {
+		return false, err
+	}
+
+	// this instance is part of the ring even if its heartbeat is late, it is still running after all
+	members = append(members, shardMemberId())
+	members = uniqueSortedMembers(members)
+
+	shardsMutex.Lock()
+	defer shardsMutex.Unlock()
+
+	if fmt.Sprint(members) == fmt.Sprint(shardsMembers) {
+		return false, nil
+	}
+	shardsMembers = members
+	shardsRing = newShardsRing(members)
+
+	return true, nil
+}
+
+func uniqueSortedMembers(members []string) []string {
+	var unique []string
+	var seen = map[string]bool{}
+
+	for _, m := range members {
+		if !seen[m] {
+			seen[m] = true
+			unique = append(unique, m)
+		}
+	}
+	sort.Strings(unique)
+
+	return unique
+}
+
+// rebalanceShardsWhileSchedulerIsRunning checks the instances alive and, when they change, removes the checks moved
+// to other instances and schedules the checks moved to this one
+func rebalanceShardsWhileSchedulerIsRunning() {
+	if !shardingEnabled() {
+		return
+	}
+	if settings.GetSettDuration(SCHSHARDSREFRESHMS) <= 0 {
+		log.Println("Shards refresh disabled, instances joining or leaving will be noticed at the next boot")
+		return
+	}
+	for {
+		time.Sleep(settings.GetSettDuration(SCHSHARDSREFRESHMS) * time.Millisecond)
+
+		changed, err := loadShardsMembers()
+		if err != nil {
+			log.Printf("Error while retrieving scheduler instances: %s\n", err.Error())
+			continue
+		}
+		if !changed {
+			continue
+		}
+		shardsMutex.RLock()
+		log.Printf("Scheduler instances changed %v, rebalancing checks\n", shardsMembers)
+		shardsMutex.RUnlock()
+		rebalanceShards()
+	}
+}
+
+func rebalanceShards() {
+	var toRemove []string
+	var added int
+
+	schedulerJobsMutex.Lock()
+	for checkId := range scheduledChecks {
+		if !ownsCheck(checkId) {
+			toRemove = append(toRemove, checkId)
+		}
+	}
+	schedulerJobsMutex.Unlock()
+
+	for _, checkId := range toRemove {
+		if unscheduleCheck(checkId) {
+			atomic.AddInt64(&jobsMovedToOtherShards, 1)
+		}
+	}
+
+	chRecords := make(chan dbhelper.CheckRecord)
+	go RetrieveEnabledChecksToBeScheduled(chRecords)
+	for record := range chRecords {
+		if !ownsCheck(record.CheckId) {
+			continue
+		}
+		schedulerJobsMutex.Lock()
+		_, exists := scheduledChecks[record.CheckId]
+		schedulerJobsMutex.Unlock()
+		if exists {
+			continue
+		}
+		err := scheduleCheck(record)
+		if err != nil {
+			atomic.AddInt64(&jobsNotScheduledBecauseNotValid, 1)
+			log.Printf("Error while scheduling check [%s]: %s\n", record.CheckId, err.Error())
+			continue
+		}
+		added++
+	}
+
+	log.Printf("Rebalance completed, %d checks moved to other instances, %d checks taken over\n", len(toRemove), added)
+}
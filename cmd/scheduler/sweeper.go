@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/dbhelper"
+	"brainyping/pkg/queuehelper"
+	"brainyping/pkg/settings"
+
+	"github.com/google/uuid"
+)
+
+// requests are in flight from the moment they are queued until the response collector saves the response
+// requests that never come back (worker crashed, message lost...) are sent again to another region of the check,
+// when the requeues are exhausted a response is sent on behalf of the worker so the request doesn't simply disappear
+
+const SCHINFLIGHTSWEEPMS = "SCH_INFLIGHT_SWEEP_MS"
+const SCHINFLIGHTTIMEOUTMS = "SCH_INFLIGHT_TIMEOUT_MS"
+const SCHINFLIGHTMAXREQUEUES = "SCH_INFLIGHT_MAX_REQUEUES"
+
+type inFlightLossesType struct {
+	lost     int64
+	requeued int64
+	timedOut int64
+	fenced   int64
+}
+
+// requests lost by region.subregion, a region losing requests probably has workers in trouble
+var inFlightLosses = map[string]*inFlightLossesType{}
+var inFlightLossesMutex = sync.Mutex{}
+
+func sweepInFlightWhileSchedulerIsRunning() {
+	if settings.GetSettDuration(SCHINFLIGHTSWEEPMS) <= 0 {
+		log.Println("In flight sweeper disabled, requests lost in flight will be ignored")
+		return
+	}
+	for {
+		time.Sleep(settings.GetSettDuration(SCHINFLIGHTSWEEPMS) * time.Millisecond)
+
+		// the in flight requests are shared by all the scheduler instances, only one of them looks after them
+		if isLeader, _ := leaderElection.Leadership(); !isLeader {
+			continue
+		}
+		sweepInFlight()
+	}
+}
+
+func sweepInFlight() {
+	beforeUnix := time.Now().Add(-settings.GetSettDuration(SCHINFLIGHTTIMEOUTMS) * time.Millisecond).Unix()
+	stale, err := retrieveStaleInFlight(beforeUnix)
+	if err != nil {
+		log.Printf("Error while retrieving in flight requests: %s\n", err.Error())
+		return
+	}
+
+	for _, inFlight := range stale {
+		// the response could arrive while we are here, the request is handled only if we are the ones removing the in flight record
+		_, claimed, err := claimInFlight(inFlight.Rid)
+		if err != nil {
+			log.Printf("Error while removing in flight record RID [%s]: %s\n", inFlight.Rid, err.Error())
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		countInFlightLoss(inFlight.Region, inFlight.SubRegion, func(l *inFlightLossesType) { l.lost++ })
+
+		// requests queued by an instance after it was replaced have been refused by the workers, the instance that took over
+		// was already queueing the same checks. Requests queued before the takeover are handled as any other request lost
+		stale, err := fencingValidator.Stale(inFlight.FencingLease, inFlight.FencingToken, inFlight.InFlightSinceUnix)
+		if err != nil {
+			log.Printf("Error while validating fencing token of in flight request RID [%s]: %s\n", inFlight.Rid, err.Error())
+		}
+		if stale {
+			countInFlightLoss(inFlight.Region, inFlight.SubRegion, func(l *inFlightLossesType) { l.fenced++ })
+			continue
+		}
+
+		check, exists, err := retrieveCheckById(inFlight.CheckId)
+		if err != nil {
+			log.Printf("Error while retrieving check [%s] of in flight request RID [%s]: %s\n", inFlight.CheckId, inFlight.Rid, err.Error())
+			continue
+		}
+		if !exists {
+			// the check has been deleted or disabled in the meantime, nobody is waiting for this response
+			continue
+		}
+
+		// the request is queued again by the leader, under its own lease
+		_, fencingToken := leaderElection.Leadership()
+		record := queuehelper.CheckRecordQueued{
+			Record:           check,
+			ScheduledUnix:    inFlight.ScheduledUnix,
+			QueuedUnix:       time.Now().Unix(),
+			RunId:            inFlight.RunId,
+			RunRegions:       inFlight.RunRegions,
+			FencingLease:     leaderElection.GetLeaseName(),
+			FencingToken:     fencingToken,
+			InFlightRequeues: inFlight.Requeues,
+		}
+
+		candidates := requeueCandidates(check.Regions, inFlight.Region, inFlight.SubRegion)
+		if inFlight.Requeues < settings.GetSettInt(SCHINFLIGHTMAXREQUEUES) && len(candidates) > 0 {
+			target := candidates[rand.Intn(len(candidates))]
+			record.InFlightRequeues++
+			queueForRegion(record, target[0], target[1])
+			countInFlightLoss(inFlight.Region, inFlight.SubRegion, func(l *inFlightLossesType) { l.requeued++ })
+			log.Printf("Request RID [%s] of check [%s] lost in %s.%s, queued again in %s.%s\n", inFlight.Rid, inFlight.CheckId, inFlight.Region, inFlight.SubRegion, target[0], target[1])
+			continue
+		}
+
+		reason := fmt.Sprintf("request RID [%s] timed out in flight after %d requeues", inFlight.Rid, inFlight.Requeues)
+		err = publishSyntheticResponse(record, inFlight.Region, inFlight.SubRegion, errorcode.INFLIGHTTIMEOUT, reason)
+		if err != nil {
+			log.Printf("Error while publishing timeout of in flight request RID [%s]: %s\n", inFlight.Rid, err.Error())
+			continue
+		}
+		countInFlightLoss(inFlight.Region, inFlight.SubRegion, func(l *inFlightLossesType) { l.timedOut++ })
+		log.Printf("Request RID [%s] of check [%s] lost in %s.%s, timed out after %d requeues\n", inFlight.Rid, inFlight.CheckId, inFlight.Region, inFlight.SubRegion, inFlight.Requeues)
+	}
+}
+
+// requeueCandidates returns the enabled regions of the check, other than the one that lost the request
+func requeueCandidates(regions [][]string, lostRegion string, lostSubRegion string) [][]string {
+	var candidates [][]string
+
+	for _, r := range enabledRegionsOnly(regions) {
+		if r[0] == lostRegion && r[1] == lostSubRegion {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+
+	return candidates
+}
+
+// publishSyntheticResponse sends the response of a request not executed through the responses queue, as a worker would do
+// it uses a new request id, the worker could still send the original response later
+func publishSyntheticResponse(record queuehelper.CheckRecordQueued, region string, subRegion string, errorCode string, reason string) error {
+	record.RequestId = fmt.Sprintf("%d--%s", time.Now().UnixNano(), uuid.NewString())
+	record.RecordOutcome = dbhelper.CheckOutcomeRecord{
+		Region:        region,
+		SubRegion:     subRegion,
+		CreatedUnix:   time.Now().Unix(),
+		Success:       false,
+		ErrorCode:     errorCode,
+		ErrorInternal: reason,
+		ErrorOriginal: reason,
+		ErrorFriendly: "The check could not be completed",
+		Message:       "The check could not be completed",
+	}
+	record.WorkerHostname = "-"
+	record.WorkerHostnameFriendly = "-"
+
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return PublishResponseForLostRequest(body)
+}
+
+func countInFlightLoss(region string, subRegion string, count func(l *inFlightLossesType)) {
+	inFlightLossesMutex.Lock()
+	defer inFlightLossesMutex.Unlock()
+
+	key := settings.SubRegionKey(region, subRegion)
+	if _, exists := inFlightLosses[key]; !exists {
+		inFlightLosses[key] = &inFlightLossesType{}
+	}
+	count(inFlightLosses[key])
+}
+
+// inFlightLossesSummary returns the counters by region, sorted to keep the statistics screen stable
+func inFlightLossesSummary() string {
+	var lines []string
+
+	inFlightLossesMutex.Lock()
+	defer inFlightLossesMutex.Unlock()
+
+	for key, l := range inFlightLosses {
+		lines = append(lines, fmt.Sprintf("%s lost %d requeued %d timed out %d fenced %d", key, l.lost, l.requeued, l.timedOut, l.fenced))
+	}
+	sort.Strings(lines)
+
+	return strings.Join(lines, " | ")
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/dbhelper"
+)
+
+// when a worker reports a failure of a check with confirmations enabled it re-queues the check to other regions
+// the failure is held here until a quorum of regions agrees the check is down, or the quorum can't be reached anymore.
+// Failures are held by run id: all the requests of a run (the regions selected by the scheduler and their confirmations)
+// vote on the same outcome
+
+type pendingConfirmationType struct {
+	original    dbhelper.CheckResponseRecordDb
+	expected    int
+	failures    int
+	successes   int
+	abstained   int
+	lastSuccess dbhelper.CheckResponseRecordDb
+	createdAt   time.Time
+}
+
+// confirmations that don't come back (worker down, queue lost...) are not waited longer than this,
+// the outcome is decided with the votes received
+const CONFIRMATIONTIMEOUT = 5 * time.Minute
+
+// the map is only used by the status changes listener goroutine so there's no need for a mutex
+var pendingConfirmations = map[string]*pendingConfirmationType{}
+var pendingConfirmationsLastPurge = time.Now()
+
+// pendingConfirmationKey returns the run id, responses of requests queued before run ids were introduced use the original request id
+func pendingConfirmationKey(record dbhelper.CheckResponseRecordDb) string {
+	if record.RunId != "" {
+		return record.RunId
+	}
+	if record.ConfirmationOf != "" {
+		return record.ConfirmationOf
+	}
+	return record.RequestId
+}
+
+// confirmationOutcome returns the record to use to detect a status change, false if there's nothing to evaluate yet
+// a confirmed failure is evaluated using the original response, a failure not confirmed using the last successful confirmation
+func confirmationOutcome(record dbhelper.CheckResponseRecordDb) (dbhelper.CheckResponseRecordDb, bool) {
+	key := pendingConfirmationKey(record)
+	pending, exists := pendingConfirmations[key]
+
+	if record.ConfirmationOf == "" {
+		if record.Success || record.ConfirmationsRequested == 0 {
+			return record, true
+		}
+		if exists {
+			// another region of the same run failed and asked for its own confirmations
+			pending.failures++
+			pending.expected += record.ConfirmationsRequested + 1
+			return decideConfirmation(key, pending, record)
+		}
+		pendingConfirmations[key] = &pendingConfirmationType{original: record, expected: record.ConfirmationsRequested + 1, failures: 1, createdAt: time.Now()}
+		return record, false
+	}
+
+	if !exists {
+		// late confirmation of a failure already decided, nothing to do
+		return record, false
+	}
+
+	switch {
+	case !record.Success && record.ErrorCode == errorcode.WORKERINTERNAL:
+		// failures on our side are not a vote
+		pending.abstained++
+	case record.Success:
+		pending.successes++
+		pending.lastSuccess = record
+	default:
+		pending.failures++
+	}
+
+	return decideConfirmation(key, pending, record)
+}
+
+func decideConfirmation(key string, pending *pendingConfirmationType, record dbhelper.CheckResponseRecordDb) (dbhelper.CheckResponseRecordDb, bool) {
+	quorum := pending.original.ConfirmQuorum
+	votesLeft := pending.expected - pending.failures - pending.successes - pending.abstained
+
+	if pending.failures >= quorum {
+		delete(pendingConfirmations, key)
+		logConfirmation(pending, "confirmed")
+		return pending.original, true
+	}
+
+	if pending.failures+votesLeft < quorum {
+		delete(pendingConfirmations, key)
+		logConfirmation(pending, "not confirmed")
+		if pending.successes == 0 {
+			// every other region failed on our side, we can't say anything about the check
+			return record, false
+		}
+		return pending.lastSuccess, true
+	}
+
+	return record, false
+}
+
+// expiredConfirmations returns the outcome of the failures still waiting for confirmations after the timeout
+// the quorum can't be reached anymore, the majority of the votes received decides. With no votes received at all
+// (confirmations lost) the original failure is all we know and it is used as it is
+func expiredConfirmations() []dbhelper.CheckResponseRecordDb {
+	var outcomes []dbhelper.CheckResponseRecordDb
+
+	if time.Since(pendingConfirmationsLastPurge) < time.Minute {
+		return nil
+	}
+	pendingConfirmationsLastPurge = time.Now()
+
+	for key, pending := range pendingConfirmations {
+		if time.Since(pending.createdAt) <= CONFIRMATIONTIMEOUT {
+			continue
+		}
+		delete(pendingConfirmations, key)
+		if pending.failures > pending.successes {
+			logConfirmation(pending, "confirmed on timeout")
+			outcomes = append(outcomes, pending.original)
+			continue
+		}
+		logConfirmation(pending, "not confirmed on timeout")
+		outcomes = append(outcomes, pending.lastSuccess)
+	}
+
+	return outcomes
+}
+
+func logConfirmation(pending *pendingConfirmationType, outcome string) {
+	log.Printf("Failure %s for CID [%s] RID [%s] RUNID [%s] %d failures %d successes %d abstained out of %d votes, quorum %d (Region %s->%s)\n",
+		outcome,
+		pending.original.CheckId,
+		pending.original.RequestId,
+		pending.original.RunId,
+		pending.failures,
+		pending.successes,
+		pending.abstained,
+		pending.expected,
+		pending.original.ConfirmQuorum,
+		pending.original.Region,
+		pending.original.SubRegion)
+}
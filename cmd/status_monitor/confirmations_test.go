@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"brainyping/pkg/dbhelper"
+)
+
+func testFailure(requestId string, region string, confirmations int) dbhelper.CheckResponseRecordDb {
+	return dbhelper.CheckResponseRecordDb{CheckId: "check1", RequestId: requestId, RunId: "run1", Region: region, SubRegion: "main", ConfirmationsRequested: confirmations, ConfirmQuorum: 2}
+}
+
+func testConfirmation(requestId string, region string, success bool) dbhelper.CheckResponseRecordDb {
+	return dbhelper.CheckResponseRecordDb{CheckId: "check1", RequestId: requestId, RunId: "run1", Region: region, SubRegion: "main", ConfirmationOf: "rid1", Success: success}
+}
+
+func TestFailureConfirmedByRunId(t *testing.T) {
+	pendingConfirmations = map[string]*pendingConfirmationType{}
+
+	if _, ready := confirmationOutcome(testFailure("rid1", "eu", 2)); ready {
+		t.Fatal("failure decided before the confirmations")
+	}
+	if _, exists := pendingConfirmations["run1"]; !exists {
+		t.Fatal("failure not held by run id")
+	}
+
+	record, ready := confirmationOutcome(testConfirmation("rid2", "us", false))
+	if !ready || record.RequestId != "rid1" {
+		t.Fatalf("expected the original failure to be confirmed, got %t %s", ready, record.RequestId)
+	}
+	if len(pendingConfirmations) != 0 {
+		t.Fatal("confirmation decided but still pending")
+	}
+}
+
+func TestExpiredConfirmationsUseTheVotesReceived(t *testing.T) {
+	pendingConfirmations = map[string]*pendingConfirmationType{}
+
+	// no confirmation came back, the original failure is all we know
+	confirmationOutcome(testFailure("rid1", "eu", 2))
+	pendingConfirmations["run1"].createdAt = time.Now().Add(-CONFIRMATIONTIMEOUT - time.Second)
+	pendingConfirmationsLastPurge = time.Now().Add(-time.Hour)
+	outcomes := expiredConfirmations()
+	if len(outcomes) != 1 || outcomes[0].RequestId != "rid1" {
+		t.Fatalf("expected the original failure, got %+v", outcomes)
+	}
+
+	// a single confirmation came back, healthy: not confirmed
+	confirmationOutcome(testFailure("rid1", "eu", 2))
+	confirmationOutcome(testConfirmation("rid2", "us", true))
+	pendingConfirmations["run1"].createdAt = time.Now().Add(-CONFIRMATIONTIMEOUT - time.Second)
+	pendingConfirmationsLastPurge = time.Now().Add(-time.Hour)
+	outcomes = expiredConfirmations()
+	if len(outcomes) != 1 || !outcomes[0].Success || outcomes[0].RequestId != "rid2" {
+		t.Fatalf("expected the successful confirmation, got %+v", outcomes)
+	}
+
+	if len(pendingConfirmations) != 0 {
+		t.Fatal("expired confirmations still pending")
+	}
+}
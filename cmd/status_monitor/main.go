@@ -10,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"brainyping/pkg/checks/errorcode"
 	"brainyping/pkg/dbhelper"
 	"brainyping/pkg/heartbeat"
 	"brainyping/pkg/initapp"
@@ -19,24 +20,28 @@ import (
 )
 
 type checkStatusType struct {
-	CheckId                   string        `bson:"checkid"`
-	ResponseDbId              string        `bson:"responsedbid"`
-	RequestId                 string        `bson:"requestid"`
-	OwnerUid                  string        `bson:"owneruid"`
-	CurrentStatus             string        `bson:"curreststatus"`
-	CurrentStatusSince        time.Time     `bson:"currentstatussince"`
-	CurrentStatusSinceUnix    int64         `bson:"currentstatussinceunix"`
-	PreviousStatus            string        `bson:"previousstatus"`
-	PreviousStatusSince       time.Time     `bson:"previousstatussince"`
-	PreviousStatusSinceUnix   int64         `bson:"previousstatussinceunix"`
-	PreviousStatusDuration    time.Duration `bson:"previousstatusduration"`
-	PreviousStatusDurationSec int64         `bson:"previousstatusdurationsec"`
-	ChangeProcessedUnix       int64         `bson:"changeprocessedunix"`
-	Region                    string        `bson:"region"`
-	SubRegion                 string        `bson:"subregion"`
-	WorkerHostname            string        `bson:"workerhostname"`
-	WorkerHostnameFriendly    string        `bson:"workerhostnamefriendly"`
-	Attempts                  int           `bson:"attempts"`
+	CheckId                   string            `bson:"checkid"`
+	ResponseDbId              string            `bson:"responsedbid"`
+	RequestId                 string            `bson:"requestid"`
+	OwnerUid                  string            `bson:"owneruid"`
+	CurrentStatus             string            `bson:"curreststatus"`
+	CurrentStatusSince        time.Time         `bson:"currentstatussince"`
+	CurrentStatusSinceUnix    int64             `bson:"currentstatussinceunix"`
+	PreviousStatus            string            `bson:"previousstatus"`
+	PreviousStatusSince       time.Time         `bson:"previousstatussince"`
+	PreviousStatusSinceUnix   int64             `bson:"previousstatussinceunix"`
+	PreviousStatusDuration    time.Duration     `bson:"previousstatusduration"`
+	PreviousStatusDurationSec int64             `bson:"previousstatusdurationsec"`
+	ChangeProcessedUnix       int64             `bson:"changeprocessedunix"`
+	Region                    string            `bson:"region"`
+	SubRegion                 string            `bson:"subregion"`
+	WorkerHostname            string            `bson:"workerhostname"`
+	WorkerHostnameFriendly    string            `bson:"workerhostnamefriendly"`
+	Attempts                  int               `bson:"attempts"`
+	ErrorCode                 string            `bson:"errorcode"`
+	RunId                     string            `bson:"runid"`
+	RunRegions                int               `bson:"runregions"`
+	RegionsStatus             map[string]string `bson:"regionsstatus"`
 }
 
 type markerType struct {
@@ -54,6 +59,7 @@ var cfunc context.CancelFunc
 const STATUSINIT = "INIT"
 const STATUSOK = "OK"
 const STATUSNOK = "NOK"
+const STATUSDEGRADED = "DEGRADED"
 const BULKSAVESIZE = 1000
 const markerSourceResponses = "RESPONSES"
 const markerSourceStatusChanges = "STATUSCHANGES"
@@ -171,14 +177,31 @@ func retrieveLastStatusMonitorMarker() {
 func detectStatusChangesListener(chReadResponses chan dbhelper.CheckResponseRecordDb, chWriteStatusChanges chan string, chWriteStatusCurrent chan string) {
 
 	for {
+		// failures whose confirmations didn't come back in time
+		for _, record := range expiredConfirmations() {
+			applyResponse(&record, chWriteStatusChanges, chWriteStatusCurrent)
+		}
 
 		select {
 		case record := <-chReadResponses:
-			if detectStatusChanges(&record) {
-				chWriteStatusCurrent <- record.CheckId
-				chWriteStatusChanges <- record.CheckId
-				logChange(record.CheckId)
+			if record.RobotsTxtChanged {
+				logRobotsTxtChange(&record)
+			}
+			record, ready := confirmationOutcome(record)
+			if !ready {
+				continue
+			}
+			// failures on our side say nothing about the target, the status stays what it was
+			if !record.Success && record.ErrorCode == errorcode.WORKERINTERNAL {
+				logWorkerInternalError(&record)
+				continue
+			}
+			// requests lost in flight or not executed say nothing about the target either, the region could have a problem though
+			if !record.Success && (record.ErrorCode == errorcode.INFLIGHTTIMEOUT || record.ErrorCode == errorcode.NOTEXECUTED) {
+				logRequestNotExecuted(&record)
+				continue
 			}
+			applyResponse(&record, chWriteStatusChanges, chWriteStatusCurrent)
 		case <-ctx.Done():
 			fmt.Println("Status change goroutine listener ended")
 			return
@@ -190,6 +213,19 @@ func detectStatusChangesListener(chReadResponses chan dbhelper.CheckResponseReco
 
 }
 
+// applyResponse evaluates the response and sends the check to the writers if its status changed
+func applyResponse(record *dbhelper.CheckResponseRecordDb, chWriteStatusChanges chan string, chWriteStatusCurrent chan string) {
+	statusChanged, regionStatusChanged := evaluateResponse(record)
+	if statusChanged {
+		chWriteStatusCurrent <- record.CheckId
+		chWriteStatusChanges <- record.CheckId
+		logChange(record.CheckId)
+	} else if regionStatusChanged {
+		// not a change of the check status, but the current status has the status of each region
+		chWriteStatusCurrent <- record.CheckId
+	}
+}
+
 func writeStatusChangesToDbBuffer(chWriteStatusChangesToDb chan string) {
 	var recordsToSave []interface{}
 	var lastSaved time.Time = time.Now()
@@ -222,29 +258,138 @@ func writeStatusChangesToDb(records *[]interface{}) {
 	utilities.FailOnError(dbhelper.SaveManyRecords(dbhelper.GetDatabaseName(), dbhelper.TablenameChecksStatusChanges, records))
 }
 
-func detectStatusChanges(record *dbhelper.CheckResponseRecordDb) bool {
-	var responseStatusString string
-	if record.Success {
-		responseStatusString = STATUSOK
-	} else {
-		responseStatusString = STATUSNOK
+func responseStatus(record *dbhelper.CheckResponseRecordDb) string {
+	if record.Success && record.Degraded {
+		return STATUSDEGRADED
+	} else if record.Success {
+		return STATUSOK
 	}
+	return STATUSNOK
+}
 
+// evaluateResponse updates the status of the region the response comes from and then the status of the check
+// returns true if the status of the check changed and true if the status of the region changed
+func evaluateResponse(record *dbhelper.CheckResponseRecordDb) (bool, bool) {
 	// create the element for the current checkID in the statuschanges element....
 	checksStatusesMutex.Lock()
 	initialiseCheckStatusElement(record)
 	checksStatusesMutex.Unlock()
 
-	if checksStatuses[record.CheckId].CurrentStatus != responseStatusString {
+	regionStatusChanged := updateRegionStatus(record)
+	status, decided := checkStatus(record)
+	if !decided {
+		// not enough responses of the run yet, the status stays what it was
+		return false, regionStatusChanged
+	}
+	statusChanged := detectStatusChanges(record, status)
+
+	return statusChanged, regionStatusChanged
+}
+
+func detectStatusChanges(record *dbhelper.CheckResponseRecordDb, status string) bool {
+	checksStatusesMutex.Lock()
+	defer checksStatusesMutex.Unlock()
+
+	if checksStatuses[record.CheckId].CurrentStatus != status {
 		// status change detected...
-		checksStatusesMutex.Lock()
-		updateCheckStatusElement(record, responseStatusString)
-		checksStatusesMutex.Unlock()
+		updateCheckStatusElement(record, status)
 		return true
 	}
 	return false
 }
 
+// checkStatus returns the status of the check and false if it can't be decided yet.
+// A run sent to a single region (RANDOM and ROUNDROBIN strategies by default) is decided by its response, as it has always been.
+// A run sent to more regions is decided by the responses of the run only, once the majority of them arrived: a single region
+// can't take the check down, NOK when the majority of the regions sees the check down, DEGRADED when only some of them
+// see it down (or slow). A failure confirmed by other regions already reached its quorum, the check is down
+func checkStatus(record *dbhelper.CheckResponseRecordDb) (string, bool) {
+	if !record.Success && record.ConfirmationsRequested > 0 {
+		return STATUSNOK, true
+	}
+
+	checksStatusesMutex.Lock()
+	defer checksStatusesMutex.Unlock()
+
+	statusRecord := checksStatuses[record.CheckId]
+	if statusRecord.RunRegions <= 1 {
+		return responseStatus(record), true
+	}
+
+	return aggregateRunStatus(statusRecord.RegionsStatus, statusRecord.RunRegions)
+}
+
+// aggregateRunStatus returns the status of a run from the status of the regions responded so far, false until the majority responded
+func aggregateRunStatus(regionsStatus map[string]string, runRegions int) (string, bool) {
+	var nok, degraded int
+	var quorum = runRegions/2 + 1
+
+	if len(regionsStatus) < quorum {
+		return "", false
+	}
+
+	for _, status := range regionsStatus {
+		switch status {
+		case STATUSNOK:
+			nok++
+		case STATUSDEGRADED:
+			degraded++
+		}
+	}
+
+	switch {
+	case nok >= quorum:
+		return STATUSNOK, true
+	case nok > 0 || degraded > 0:
+		return STATUSDEGRADED, true
+	}
+
+	return STATUSOK, true
+}
+
+// updateRegionStatus keeps the status seen from each region/subregion in the last run of the check, checks sent to more
+// regions on each run can be healthy from a region and down from another one. A new run starts from scratch, regions not
+// part of it (picked by a previous run, disabled or removed) don't count anymore
+func updateRegionStatus(record *dbhelper.CheckResponseRecordDb) bool {
+	var regionKey = record.Region + "." + record.SubRegion
+	var status = responseStatus(record)
+
+	checksStatusesMutex.Lock()
+	defer checksStatusesMutex.Unlock()
+
+	statusRecord := checksStatuses[record.CheckId]
+	newRun := record.RunId != statusRecord.RunId || record.RunId == ""
+	// the map is copied because the current status writer could be saving the previous one
+	regionsStatus := map[string]string{regionKey: status}
+	if !newRun {
+		for k, v := range statusRecord.RegionsStatus {
+			if k != regionKey {
+				regionsStatus[k] = v
+			}
+		}
+	}
+	changed := !sameRegionsStatus(statusRecord.RegionsStatus, regionsStatus)
+	statusRecord.RunId = record.RunId
+	statusRecord.RunRegions = record.RunRegions
+	statusRecord.RegionsStatus = regionsStatus
+	checksStatuses[record.CheckId] = statusRecord
+
+	return changed
+}
+
+func sameRegionsStatus(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if status, exists := b[k]; !exists || status != v {
+			return false
+		}
+	}
+
+	return true
+}
+
 func updateCheckStatusElement(record *dbhelper.CheckResponseRecordDb, newStatus string) {
 
 	statusRecord := checksStatuses[record.CheckId]
@@ -267,6 +412,7 @@ func updateCheckStatusElement(record *dbhelper.CheckResponseRecordDb, newStatus
 	statusRecord.Region = record.Region
 	statusRecord.SubRegion = record.SubRegion
 	statusRecord.Attempts = record.Attempts
+	statusRecord.ErrorCode = record.ErrorCode
 
 	checksStatuses[record.CheckId] = statusRecord
 }
@@ -293,14 +439,49 @@ func initialiseCheckStatusElement(record *dbhelper.CheckResponseRecordDb) {
 
 func logChange(checkId string) {
 
-	log.Printf("Status change detected at %s for CID [%s] RID [%s] new status [%s] previously was [%s] for [%s] (%d attempts - Region %s->%s)\n",
+	log.Printf("Status change detected at %s for CID [%s] RID [%s] new status [%s] error code [%s] previously was [%s] for [%s] (%d attempts - Region %s->%s)\n",
 		checksStatuses[checkId].CurrentStatusSince.Format(time.Stamp),
 		checksStatuses[checkId].CheckId,
 		checksStatuses[checkId].RequestId,
 		checksStatuses[checkId].CurrentStatus,
+		checksStatuses[checkId].ErrorCode,
 		checksStatuses[checkId].PreviousStatus,
 		checksStatuses[checkId].PreviousStatusDuration,
 		checksStatuses[checkId].Attempts,
 		checksStatuses[checkId].Region,
 		checksStatuses[checkId].SubRegion)
 }
+
+// robots.txt changes are not status changes but an unexpected change could hurt the website SEO so we want to flag them
+func logRobotsTxtChange(record *dbhelper.CheckResponseRecordDb) {
+	log.Printf("Robots.txt change detected at %s for CID [%s] RID [%s] new hash [%s] blocking all [%t] (Region %s->%s)\n",
+		time.Unix(record.ProcessedUnix, 0).Format(time.Stamp),
+		record.CheckId,
+		record.RequestId,
+		record.RobotsTxtHash,
+		record.RobotsTxtBlocksAll,
+		record.Region,
+		record.SubRegion)
+}
+
+func logWorkerInternalError(record *dbhelper.CheckResponseRecordDb) {
+	log.Printf("Worker internal error ignored at %s for CID [%s] RID [%s] error [%s] (worker %s - Region %s->%s)\n",
+		time.Unix(record.ProcessedUnix, 0).Format(time.Stamp),
+		record.CheckId,
+		record.RequestId,
+		record.ErrorInternal,
+		record.WorkerHostnameFriendly,
+		record.Region,
+		record.SubRegion)
+}
+
+func logRequestNotExecuted(record *dbhelper.CheckResponseRecordDb) {
+	log.Printf("Request not executed ignored at %s for CID [%s] RID [%s] code [%s] error [%s] (Region %s->%s)\n",
+		time.Unix(record.ProcessedUnix, 0).Format(time.Stamp),
+		record.CheckId,
+		record.RequestId,
+		record.ErrorCode,
+		record.ErrorInternal,
+		record.Region,
+		record.SubRegion)
+}
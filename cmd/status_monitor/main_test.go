@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"brainyping/pkg/dbhelper"
+)
+
+func testResponse(region string, success bool) dbhelper.CheckResponseRecordDb {
+	return dbhelper.CheckResponseRecordDb{CheckId: "check1", Region: region, SubRegion: "main", Success: success, RunId: "run1"}
+}
+
+func testRunResponse(runId string, runRegions int, region string, success bool) dbhelper.CheckResponseRecordDb {
+	record := testResponse(region, success)
+	record.RunId = runId
+	record.RunRegions = runRegions
+
+	return record
+}
+
+func TestStatusWithMixedRegionsOutcomes(t *testing.T) {
+	checksStatuses = map[string]checkStatusType{}
+
+	steps := []struct {
+		runId    string
+		region   string
+		success  bool
+		expected string
+		changed  bool
+	}{
+		// the first response of a run sent to 3 regions doesn't decide anything
+		{"run1", "eu", true, STATUSINIT, false},
+		{"run1", "us", true, STATUSOK, true},
+		{"run1", "ap", true, STATUSOK, false},
+		// down from a single region out of three, the check is not down
+		{"run2", "eu", false, STATUSOK, false},
+		{"run2", "us", true, STATUSDEGRADED, true},
+		{"run2", "ap", true, STATUSDEGRADED, false},
+		// down from the majority of the regions
+		{"run3", "eu", false, STATUSDEGRADED, false},
+		{"run3", "us", false, STATUSNOK, true},
+		{"run3", "ap", true, STATUSNOK, false},
+		// the regions down in the previous run don't count anymore
+		{"run4", "eu", true, STATUSNOK, false},
+		{"run4", "us", true, STATUSOK, true},
+	}
+
+	for i, step := range steps {
+		record := testRunResponse(step.runId, 3, step.region, step.success)
+		changed, _ := evaluateResponse(&record)
+		if changed != step.changed || checksStatuses["check1"].CurrentStatus != step.expected {
+			t.Fatalf("step %d: expected status %s (changed %t), got %s (changed %t)", i, step.expected, step.changed, checksStatuses["check1"].CurrentStatus, changed)
+		}
+	}
+	if len(checksStatuses["check1"].RegionsStatus) != 2 {
+		t.Fatalf("expected only the regions of the last run, got %v", checksStatuses["check1"].RegionsStatus)
+	}
+}
+
+func TestStatusWithRandomRegion(t *testing.T) {
+	checksStatuses = map[string]checkStatusType{}
+
+	// each run is sent to one region picked at random out of three, each response decides the status
+	steps := []struct {
+		region   string
+		success  bool
+		expected string
+	}{
+		{"eu", true, STATUSOK},
+		{"us", true, STATUSOK},
+		{"ap", false, STATUSNOK},
+		{"eu", false, STATUSNOK},
+		// recovered, even if the other regions were down the last time they were picked
+		{"us", true, STATUSOK},
+		{"us", true, STATUSOK},
+	}
+
+	for i, step := range steps {
+		record := testRunResponse(fmt.Sprintf("run%d", i), 1, step.region, step.success)
+		evaluateResponse(&record)
+		if checksStatuses["check1"].CurrentStatus != step.expected {
+			t.Fatalf("step %d: expected status %s, got %s", i, step.expected, checksStatuses["check1"].CurrentStatus)
+		}
+		if len(checksStatuses["check1"].RegionsStatus) != 1 {
+			t.Fatalf("step %d: expected only the region of the last run, got %v", i, checksStatuses["check1"].RegionsStatus)
+		}
+	}
+}
+
+func TestStatusOfSingleRegionCheck(t *testing.T) {
+	checksStatuses = map[string]checkStatusType{}
+
+	record := testResponse("eu", true)
+	evaluateResponse(&record)
+	record = testResponse("eu", false)
+	evaluateResponse(&record)
+	if checksStatuses["check1"].CurrentStatus != STATUSNOK {
+		t.Fatalf("expected %s, got %s", STATUSNOK, checksStatuses["check1"].CurrentStatus)
+	}
+}
+
+func TestConfirmedFailureIsDown(t *testing.T) {
+	checksStatuses = map[string]checkStatusType{}
+
+	for _, region := range []string{"eu", "us", "ap"} {
+		record := testResponse(region, true)
+		evaluateResponse(&record)
+	}
+	// the other regions already agreed the check is down, their votes are not in the regions status
+	record := testResponse("eu", false)
+	record.ConfirmationsRequested = 2
+	evaluateResponse(&record)
+	if checksStatuses["check1"].CurrentStatus != STATUSNOK {
+		t.Fatalf("expected %s, got %s", STATUSNOK, checksStatuses["check1"].CurrentStatus)
+	}
+}
@@ -6,23 +6,29 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"os/signal"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"brainyping/pkg/checks"
+	"brainyping/pkg/checks/errorcode"
 	"brainyping/pkg/checks/httpcheck"
+	"brainyping/pkg/checks/tlscheck"
 	"brainyping/pkg/dbhelper"
 	"brainyping/pkg/heartbeat"
 	"brainyping/pkg/initapp"
 	"brainyping/pkg/internalstatusmonitorapi"
+	"brainyping/pkg/leaderelection"
 	"brainyping/pkg/queuehelper"
 	"brainyping/pkg/settings"
 	_ "brainyping/pkg/settings"
 	"brainyping/pkg/utilities"
 
+	"github.com/google/uuid"
 	"github.com/streadway/amqp"
 )
 
@@ -71,8 +77,16 @@ const WORKERREGION = "WORKER_REGION"
 const WORKERSUBREGION = "WORKER_SUBREGION"
 const WRKGOROUTINES = "WRK_GOROUTINES"
 const WRKHTTPUSERAGENT = "WRK_HTTP_USER_AGENT"
+const WRKHTTPTIMEOUTMS = "WRK_HTTP_TIMEOUT_MS"
+const WRKHTTPMAXBODYBYTES = "WRK_HTTP_MAX_BODY_BYTES"
+const WRKTLSWARNINGDAYS = "WRK_TLS_WARNING_DAYS"
 const QUEUECONSUMERNAME = "worker"
 const WRKAPIPORT = "WRK_API_PORT"
+const WRKFENCINGREFRESHMS = "WRK_FENCING_REFRESH_MS"
+
+// nil when the fencing token of the requests is not checked
+var fencingValidator *leaderelection.FencingValidatorType
+var msgFenced int64
 
 func main() {
 	initapp.InitApp("WORKER")
@@ -92,6 +106,12 @@ func main() {
 
 	printGreetings()
 	httpcheck.HttpCheckDefaultUserAgent = settings.GetSettStr(WRKHTTPUSERAGENT)
+	httpcheck.HttpCheckDefaultTimeout = settings.GetSettDuration(WRKHTTPTIMEOUTMS) * time.Millisecond
+	httpcheck.HttpCheckMaxBodyBytes = settings.GetSettInt64(WRKHTTPMAXBODYBYTES)
+	tlscheck.TlsCheckDefaultWarningDays = settings.GetSettInt(WRKTLSWARNINGDAYS)
+	if settings.GetSettDuration(WRKFENCINGREFRESHMS) > 0 {
+		fencingValidator = leaderelection.NewFencingValidator(settings.GetSettDuration(WRKFENCINGREFRESHMS)*time.Millisecond, dbhelper.GetClient(), dbhelper.GetDatabaseName(), dbhelper.TablenameLeases)
+	}
 
 	// create the context
 	ctx, cfunc := context.WithCancel(context.Background())
@@ -159,6 +179,13 @@ func printGreetings() {
 	headers := []string{"REGION", "SUBREGION", "HOSTNAME", "IP"}
 	row := [][]string{{settings.GetSettStr(WORKERREGION), settings.GetSettStr(WORKERSUBREGION), workerHostName, workerIP}}
 	utilities.PrintTable(headers, row)
+
+	// show the check types this worker is able to process
+	row = [][]string{}
+	for _, c := range checks.ListCheckers() {
+		row = append(row, []string{c.Type(), strings.Join(c.SubTypes(), ","), c.Description()})
+	}
+	utilities.PrintTable([]string{"TYPE", "SUB TYPES", "DESCRIPTION"}, row)
 }
 
 func startTheWorkers(ctx context.Context, ch chan amqp.Delivery) {
@@ -239,6 +266,10 @@ forloop:
 				utilities.FailOnError(err)
 			}
 
+			if requestFenced(&messageQueued) {
+				continue
+			}
+
 			messageQueued.ReceivedByWorkerUnix = time.Now().Unix()
 			messageQueued.WorkerHostname = workerHostName
 			messageQueued.WorkerHostnameFriendly = workerHostNameFriendly
@@ -273,6 +304,8 @@ forloop:
 			messageQueued.RecordOutcome.Region = settings.GetSettStr(WORKERREGION)
 			messageQueued.RecordOutcome.SubRegion = settings.GetSettStr(WORKERSUBREGION)
 
+			requestConfirmations(&messageQueued)
+
 			jsonRecord, _ := json.Marshal(messageQueued)
 			err = PublishResponseForCheckProcessed(jsonRecord)
 			utilities.FailOnError(err)
@@ -289,6 +322,108 @@ forloop:
 
 }
 
+// requestFenced returns true if the request has been queued by a scheduler after it was replaced, the request is not executed
+// the scheduler that took over was already queueing the same checks, executing it would only produce a duplicate.
+// The requests queued before the takeover are executed, nobody else is going to queue them again
+func requestFenced(messageQueued *queuehelper.CheckRecordQueued) bool {
+	if fencingValidator == nil {
+		return false
+	}
+	stale, err := fencingValidator.Stale(messageQueued.FencingLease, messageQueued.FencingToken, messageQueued.QueuedUnix)
+	if err != nil {
+		// better a duplicate than a request not executed at all
+		log.Printf("Unable to validate fencing token of RID [%s], executing it anyway: %s\n", messageQueued.RequestId, err.Error())
+		return false
+	}
+	if stale {
+		atomic.AddInt64(&msgFenced, 1)
+		log.Printf("Request RID [%s] refused, queued by [%s] with fencing token %d after the lease changed holder\n", messageQueued.RequestId, messageQueued.FencingLease, messageQueued.FencingToken)
+	}
+
+	return stale
+}
+
+// requestConfirmations re-queues a failed check to other regions/subregions, the status monitor will declare the check down
+// only if a quorum of regions agrees. Confirmations are never confirmed again and failures on our side are not confirmed at all
+func requestConfirmations(messageQueued *queuehelper.CheckRecordQueued) {
+	var candidates [][]string
+	var confirmation queuehelper.CheckRecordQueued
+
+	if messageQueued.RecordOutcome.Success || messageQueued.Record.ConfirmRegions <= 0 || messageQueued.ConfirmationOf != "" {
+		return
+	}
+	if messageQueued.RecordOutcome.ErrorCode == errorcode.WORKERINTERNAL {
+		return
+	}
+
+	candidates = confirmationCandidates(messageQueued.Record.Regions, settings.GetSettStr(WORKERREGION), settings.GetSettStr(WORKERSUBREGION))
+	if len(candidates) > messageQueued.Record.ConfirmRegions {
+		candidates = candidates[:messageQueued.Record.ConfirmRegions]
+	}
+
+	for _, c := range candidates {
+		confirmation = queuehelper.CheckRecordQueued{
+			Record:         messageQueued.Record,
+			ScheduledUnix:  messageQueued.ScheduledUnix,
+			QueuedUnix:     time.Now().Unix(),
+			RequestId:      fmt.Sprintf("%d--%s", time.Now().UnixNano(), uuid.NewString()),
+			RunId:          messageQueued.RunId,
+			RunRegions:     messageQueued.RunRegions,
+			FencingLease:   messageQueued.FencingLease,
+			FencingToken:   messageQueued.FencingToken,
+			ConfirmationOf: messageQueued.RequestId,
+		}
+		jsonRecord, _ := json.Marshal(confirmation)
+		err := PublishRequestForConfirmation(jsonRecord, c[0], c[1])
+		if err != nil {
+			// a confirmation not sent is a vote missing, the quorum is calculated on the confirmations actually sent
+			log.Printf("Unable to send confirmation for RID [%s] to %s.%s: %s\n", messageQueued.RequestId, c[0], c[1], err.Error())
+			continue
+		}
+		messageQueued.ConfirmationsRequested++
+	}
+
+	if messageQueued.ConfirmationsRequested == 0 {
+		return
+	}
+
+	// by default the majority of the regions involved, the original one included
+	messageQueued.ConfirmQuorum = (messageQueued.ConfirmationsRequested+1)/2 + 1
+	if messageQueued.Record.ConfirmQuorum > 0 {
+		messageQueued.ConfirmQuorum = messageQueued.Record.ConfirmQuorum
+	}
+	if messageQueued.ConfirmQuorum > messageQueued.ConfirmationsRequested+1 {
+		messageQueued.ConfirmQuorum = messageQueued.ConfirmationsRequested + 1
+	}
+}
+
+// confirmationCandidates returns the enabled regions/subregions of the check other than the one of this worker, in random order
+// with the subregions of other regions first (a failure seen from another region is a stronger confirmation)
+func confirmationCandidates(regions [][]string, region string, subRegion string) [][]string {
+	var otherRegions [][]string
+	var sameRegion [][]string
+
+	regionsList, err := settings.GetRegionsList()
+	if err != nil {
+		return nil
+	}
+	enabled := settings.EnabledSubRegions(regionsList)
+
+	for _, i := range rand.Perm(len(regions)) {
+		r := regions[i]
+		if len(r) < 2 || (r[0] == region && r[1] == subRegion) || !enabled[settings.SubRegionKey(r[0], r[1])] {
+			continue
+		}
+		if r[0] != region {
+			otherRegions = append(otherRegions, r)
+		} else {
+			sameRegion = append(sameRegion, r)
+		}
+	}
+
+	return append(otherRegions, sameRegion...)
+}
+
 func unmarshalMessageBody(body *[]byte, unmarshalledMessage *queuehelper.CheckRecordQueued) error {
 	err := json.Unmarshal(*body, unmarshalledMessage)
 	if err != nil {
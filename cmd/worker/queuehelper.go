@@ -14,6 +14,11 @@ func PublishResponseForCheckProcessed(body []byte) error {
 	return err
 }
 
+// PublishRequestForConfirmation sends the check to another region/subregion to confirm a failure
+func PublishRequestForConfirmation(body []byte, region string, subRegion string) error {
+	return queuehelper.PublishRequestToTopicExchange(queuehelper.BuildRequestsQueueBindingKey(region, subRegion), body)
+}
+
 func ConsumeQueueForPendingChecks(ctx context.Context, ch chan<- amqp.Delivery) error {
 	queueName := queuehelper.BuildRequestsQueueName(settings.GetSettStr(WORKERREGION), settings.GetSettStr(WORKERSUBREGION))
 	return queuehelper.StartConsumingMessages(ctx, QUEUECONSUMERNAME, queueName, ch)
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"strconv"
+	"sync/atomic"
 
 	"brainyping/pkg/settings"
 	"brainyping/pkg/utilities"
@@ -45,6 +46,7 @@ func ShowWorkerStats(duration time.Duration) {
 		utilities.PrintTable(tableHeaders, rows)
 
 		fmt.Printf("Total %d  (%.2f/s)     %s       \n", workersMetadata.workersTotalMsgReceived, speedCalculator(workersMetadata.workersTotalMsgReceived), time.Now().Format(time.Stamp))
+		fmt.Printf("Refused (fencing token no longer valid) %d\n", atomic.LoadInt64(&msgFenced))
 
 		// go to sleep, good boy!
 		time.Sleep(time.Millisecond * 300)
@@ -2,24 +2,52 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
-	"brainyping/pkg/checks/httpcheck"
+	"brainyping/pkg/checks"
+	"brainyping/pkg/dbhelper"
 	"brainyping/pkg/initapp"
 	"brainyping/pkg/utilities"
 )
 
 func main() {
+	var port int
+	var err error
+
 	initapp.InitApp("WORKERCLI")
+	printSupportedChecks()
+
+	checkType := utilities.ReadUserInput("CHECK TYPE? (leave blank for HTTP) ")
+	if checkType == "" {
+		checkType = "HTTP"
+	}
 	subType := utilities.ReadUserInput("CHECK SUB TYPE? (leave blank for GET) ")
 	if subType == "" {
 		subType = "GET"
 	}
 	url := utilities.ReadUserInput("HOST? (include protocol and port if necessary) ")
+	portInput := utilities.ReadUserInput("PORT? (leave blank if not needed) ")
+	if portInput != "" {
+		port, err = strconv.Atoi(portInput)
+		utilities.FailOnError(err)
+	}
 	ua := utilities.ReadUserInput("USER AGENT? (leave blank to use default) ")
 
-	checkReponse, err := httpcheck.ProcessCheck(url, subType, ua)
+	record := dbhelper.CheckRecord{Type: strings.ToUpper(checkType), SubType: strings.ToUpper(subType), Host: url, Port: port, UserAgent: ua}
+	utilities.FailOnError(checks.ValidateRecord(record))
+
+	checkReponse, err := checks.ProcessCheckFromCli(record)
 	utilities.FailOnError(err)
 
 	fmt.Printf("%v", checkReponse)
 
 }
+
+func printSupportedChecks() {
+	var rows [][]string
+	for _, c := range checks.ListCheckers() {
+		rows = append(rows, []string{c.Type(), strings.Join(c.SubTypes(), ","), c.Description()})
+	}
+	utilities.PrintTable([]string{"TYPE", "SUB TYPES", "DESCRIPTION"}, rows)
+}
@@ -3,7 +3,14 @@ package checks
 import (
 	"time"
 
+	_ "brainyping/pkg/checks/dnscheck"
+	"brainyping/pkg/checks/errorcode"
 	"brainyping/pkg/checks/httpcheck"
+	_ "brainyping/pkg/checks/mailcheck"
+	_ "brainyping/pkg/checks/netcheck"
+	_ "brainyping/pkg/checks/pingcheck"
+	"brainyping/pkg/checks/registry"
+	_ "brainyping/pkg/checks/tlscheck"
 	"brainyping/pkg/dbhelper"
 	"brainyping/pkg/queuehelper"
 )
@@ -12,15 +19,8 @@ func ProcessCheckFromQueue(check *queuehelper.CheckRecordQueued) error {
 	var checkResponse dbhelper.CheckOutcomeRecord
 	var err error
 	var checkStart time.Time = time.Now()
-	switch check.Record.Type {
-	case "HTTP":
-		checkResponse, err = httpcheck.ProcessCheck(check.Record.Host, check.Record.SubType, check.Record.UserAgent)
-		break
-	case "NET":
-		// netcheck.ProcessRequest(check)
-		break
-	default:
-	}
+
+	checkResponse, err = processCheck(check.Record)
 
 	checkResponse.CreatedUnix = time.Now().Unix()
 	checkResponse.TimeSpent = time.Since(checkStart).Microseconds()
@@ -29,14 +29,14 @@ func ProcessCheckFromQueue(check *queuehelper.CheckRecordQueued) error {
 	return err
 }
 
-func ProcessHTTPCheckFromCli(subType string, url string, userAgent string) (dbhelper.CheckOutcomeRecord, error) {
+func ProcessCheckFromCli(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
 	var checkResponse dbhelper.CheckOutcomeRecord
 	var err error
 	var checkStart time.Time = time.Now()
 
-	checkResponse, err = httpcheck.ProcessCheck(url, subType, userAgent)
+	checkResponse, err = processCheck(record)
 	if err != nil {
-		return dbhelper.CheckOutcomeRecord{}, err
+		return checkResponse, err
 	}
 	checkResponse.CreatedUnix = time.Now().Unix()
 	checkResponse.TimeSpent = time.Since(checkStart).Microseconds()
@@ -44,3 +44,67 @@ func ProcessHTTPCheckFromCli(subType string, url string, userAgent string) (dbhe
 	return checkResponse, nil
 
 }
+
+// processCheck validates the check against the registry before running it
+// checks not valid produce a failed outcome explaining why, so they are not mistaken for a target failure
+func processCheck(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	var outcome dbhelper.CheckOutcomeRecord
+
+	err := registry.Validate(record)
+	if err != nil {
+		outcome.ErrorInternal = "Check not valid: " + err.Error()
+		outcome.ErrorOriginal = err.Error()
+		outcome.ErrorFriendly = "Check configuration not valid"
+		outcome.Message = outcome.ErrorFriendly
+		outcome.ErrorCode = errorcode.WORKERINTERNAL
+		return outcome, err
+	}
+
+	checker, _ := registry.Get(record.Type)
+
+	outcome, err = checker.Process(record)
+	classifyOutcome(&outcome, err)
+
+	return outcome, err
+}
+
+// assertions with their own error code, the other assertions failed are classified as ASSERTION
+var assertionsErrorCodes = map[string]string{
+	httpcheck.ASSERTIONSTATUSCODE:        errorcode.BADSTATUS,
+	httpcheck.ASSERTIONREDIRECTLOOP:      errorcode.REDIRECTLOOP,
+	httpcheck.ASSERTIONREDIRECTDOWNGRADE: errorcode.REDIRECTDOWNGRADE,
+	httpcheck.ASSERTIONREDIRECTMAX:       errorcode.REDIRECTMAX,
+	httpcheck.ASSERTIONREDIRECTHOST:      errorcode.REDIRECTHOST,
+}
+
+// classifyOutcome sets the error code of failed outcomes when the check didn't set it already
+// checks return an error only for problems on our side, so those are never counted as customer downtime
+func classifyOutcome(outcome *dbhelper.CheckOutcomeRecord, err error) {
+	if err != nil {
+		outcome.Success = false
+		outcome.ErrorCode = errorcode.WORKERINTERNAL
+		return
+	}
+	if outcome.Success || outcome.ErrorCode != "" {
+		return
+	}
+
+	switch {
+	case assertionsErrorCodes[outcome.FailedAssertion] != "":
+		outcome.ErrorCode = assertionsErrorCodes[outcome.FailedAssertion]
+	case outcome.FailedAssertion != "":
+		outcome.ErrorCode = errorcode.ASSERTION
+	default:
+		outcome.ErrorCode = errorcode.OTHER
+	}
+}
+
+// ValidateRecord makes sure the check type/subtype are supported and the check has the fields it needs
+func ValidateRecord(record dbhelper.CheckRecord) error {
+	return registry.Validate(record)
+}
+
+// ListCheckers returns the check types supported
+func ListCheckers() []registry.Checker {
+	return registry.List()
+}
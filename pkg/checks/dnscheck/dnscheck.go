@@ -0,0 +1,203 @@
+package dnscheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/checks/registry"
+	"brainyping/pkg/dbhelper"
+)
+
+const ASSERTIONANSWERS = "DNSANSWERS"
+
+type checker struct{}
+
+func init() {
+	registry.Register(checker{})
+}
+
+func (checker) Type() string {
+	return "DNS"
+}
+
+func (checker) SubTypes() []string {
+	return []string{"A", "AAAA", "CNAME", "MX", "TXT"}
+}
+
+func (checker) Description() string {
+	return "DNS resolution of the record type in the subtype, answers can be compared with an expected set"
+}
+
+func (checker) ConfigSchema() []registry.ConfigField {
+	return []registry.ConfigField{
+		{Field: "host", Description: "name to resolve", Required: true},
+		{Field: "dnsresolver", Description: "resolver address (host:port), system resolver used if empty"},
+		{Field: "dnsexpectedanswers", Description: "expected answers, any answer is accepted if empty"},
+	}
+}
+
+func (checker) Process(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	return ProcessCheck(record)
+}
+
+func ProcessCheck(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	var outcome dbhelper.CheckOutcomeRecord
+	var err error
+
+	switch record.SubType {
+	case "A", "AAAA", "CNAME", "MX", "TXT":
+		outcome, err = subTypeResolve(record)
+		break
+	default:
+		err = errors.New("subType subtype not correct")
+	}
+
+	return outcome, err
+}
+
+// subTypeResolve resolves the record type stored in the check subtype and compares the answers with the expected ones (if any)
+// answers are compared as a set, order is not relevant and case is relevant only for TXT records
+func subTypeResolve(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	var err error
+	var timeout = 10000 * time.Millisecond
+	var returnedValue dbhelper.CheckOutcomeRecord
+	var resolver *net.Resolver
+	var answers []string
+	var resolveStart time.Time
+	var ctx, cancelFunc = context.WithTimeout(context.Background(), timeout)
+
+	defer cancelFunc()
+
+	resolver = newResolver(record.DnsResolver, timeout)
+
+	resolveStart = time.Now()
+	answers, err = resolve(ctx, resolver, record.SubType, record.Host)
+	returnedValue.DnsTime = time.Since(resolveStart).Microseconds()
+	if err != nil {
+		returnedValue.ErrorInternal = "Error while resolving: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = returnedValue.ErrorInternal
+		returnedValue.Message = returnedValue.ErrorFriendly
+		returnedValue.ErrorCode = errorcode.DNS
+		// resolution errors are exposed to the customers so returned error is nil
+		return returnedValue, nil
+	}
+
+	returnedValue.DnsAnswers = normaliseAnswers(record.SubType, answers)
+	returnedValue.Message = fmt.Sprintf("%s %s resolved to %s", record.SubType, record.Host, strings.Join(returnedValue.DnsAnswers, ","))
+
+	if len(record.DnsExpectedAnswers) > 0 && !sameAnswers(returnedValue.DnsAnswers, normaliseAnswers(record.SubType, record.DnsExpectedAnswers)) {
+		returnedValue.ErrorOriginal = fmt.Sprintf("Answers %v do not match the expected %v", returnedValue.DnsAnswers, record.DnsExpectedAnswers)
+		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+		returnedValue.FailedAssertion = ASSERTIONANSWERS
+		return returnedValue, nil
+	}
+
+	returnedValue.Success = true
+
+	return returnedValue, nil
+}
+
+// newResolver returns a resolver querying the address provided, if the address is empty the system resolver is used
+func newResolver(address string, timeout time.Duration) *net.Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := net.Dialer{Timeout: timeout}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// resolve performs the lookup for the record type requested
+// MX answers only contain the mail server host, preference is not considered
+func resolve(ctx context.Context, resolver *net.Resolver, recordType string, host string) ([]string, error) {
+	var answers []string
+
+	switch recordType {
+	case "A", "AAAA":
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if (ip.IP.To4() != nil) == (recordType == "A") {
+				answers = append(answers, ip.IP.String())
+			}
+		}
+		if len(answers) == 0 {
+			return nil, errors.New(fmt.Sprintf("no %s record found for %s", recordType, host))
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, cname)
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			answers = append(answers, mx.Host)
+		}
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, txts...)
+	}
+
+	return answers, nil
+}
+
+// normaliseAnswers makes answers comparable, names are case insensitive and can be fully qualified (trailing dot)
+// TXT data is case sensitive (DKIM keys, verification tokens...) and it's compared and stored as it is
+func normaliseAnswers(recordType string, answers []string) []string {
+	var normalised []string
+	for _, a := range answers {
+		if recordType == "TXT" {
+			normalised = append(normalised, a)
+			continue
+		}
+		normalised = append(normalised, strings.TrimSuffix(strings.ToLower(strings.TrimSpace(a)), "."))
+	}
+	sort.Strings(normalised)
+	return normalised
+}
+
+// sameAnswers compares two sorted lists of answers ignoring duplicates
+func sameAnswers(a []string, b []string) bool {
+	var setA = map[string]bool{}
+	var setB = map[string]bool{}
+	for _, v := range a {
+		setA[v] = true
+	}
+	for _, v := range b {
+		setB[v] = true
+	}
+	if len(setA) != len(setB) {
+		return false
+	}
+	for k := range setA {
+		if !setB[k] {
+			return false
+		}
+	}
+	return true
+}
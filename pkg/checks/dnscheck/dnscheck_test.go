@@ -0,0 +1,136 @@
+package dnscheck
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"brainyping/pkg/dbhelper"
+)
+
+const dnsTypeA = 1
+const dnsTypeTXT = 16
+
+// startStubResolver answers the A and TXT queries with the records passed, any other query gets an empty answer
+func startStubResolver(t *testing.T, a []net.IP, txt []string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			response := stubResponse(buf[:n], a, txt)
+			if response != nil {
+				_, _ = conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func stubResponse(query []byte, a []net.IP, txt []string) []byte {
+	var answers [][]byte
+
+	if len(query) < 12 {
+		return nil
+	}
+	// the question starts after the header, the name is a list of labels ending with a zero length label
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5 // zero length label, type and class
+	if end > len(query) {
+		return nil
+	}
+	qType := binary.BigEndian.Uint16(query[end-4 : end-2])
+
+	switch qType {
+	case dnsTypeA:
+		for _, ip := range a {
+			answers = append(answers, stubAnswer(dnsTypeA, ip.To4()))
+		}
+	case dnsTypeTXT:
+		for _, s := range txt {
+			answers = append(answers, stubAnswer(dnsTypeTXT, append([]byte{byte(len(s))}, s...)))
+		}
+	}
+
+	response := make([]byte, 12)
+	copy(response[0:2], query[0:2])
+	binary.BigEndian.PutUint16(response[2:4], 0x8180) // response, recursion desired and available, no error
+	binary.BigEndian.PutUint16(response[4:6], 1)
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(answers)))
+	response = append(response, query[12:end]...)
+	for _, answer := range answers {
+		response = append(response, answer...)
+	}
+
+	return response
+}
+
+func stubAnswer(recordType uint16, data []byte) []byte {
+	answer := []byte{0xc0, 0x0c} // pointer to the name in the question
+	answer = binary.BigEndian.AppendUint16(answer, recordType)
+	answer = binary.BigEndian.AppendUint16(answer, 1) // class IN
+	answer = binary.BigEndian.AppendUint32(answer, 60)
+	answer = binary.BigEndian.AppendUint16(answer, uint16(len(data)))
+
+	return append(answer, data...)
+}
+
+func TestTxtAnswersAreCaseSensitive(t *testing.T) {
+	resolver := startStubResolver(t, nil, []string{"v=DKIM1; p=MIGfMA0GCSqGSIb3"})
+	record := dbhelper.CheckRecord{Host: "example.test", Type: "DNS", SubType: "TXT", DnsResolver: resolver}
+
+	record.DnsExpectedAnswers = []string{"v=DKIM1; p=MIGfMA0GCSqGSIb3"}
+	outcome, err := ProcessCheck(record)
+	if err != nil || !outcome.Success {
+		t.Fatalf("expected success, got %v %+v", err, outcome)
+	}
+	if outcome.DnsAnswers[0] != "v=DKIM1; p=MIGfMA0GCSqGSIb3" {
+		t.Fatalf("TXT answer altered: %v", outcome.DnsAnswers)
+	}
+
+	record.DnsExpectedAnswers = []string{"v=dkim1; p=migfma0gcsqgsib3"}
+	outcome, err = ProcessCheck(record)
+	if err != nil || outcome.Success || outcome.FailedAssertion != ASSERTIONANSWERS {
+		t.Fatalf("expected answers assertion failure, got %v %+v", err, outcome)
+	}
+}
+
+func TestNameAnswersAreCaseInsensitive(t *testing.T) {
+	resolver := startStubResolver(t, []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.1")}, nil)
+	record := dbhelper.CheckRecord{Host: "example.test", Type: "DNS", SubType: "A", DnsResolver: resolver}
+
+	record.DnsExpectedAnswers = []string{"192.0.2.1", " 192.0.2.10 "}
+	outcome, err := ProcessCheck(record)
+	if err != nil || !outcome.Success {
+		t.Fatalf("expected success, got %v %+v", err, outcome)
+	}
+
+	record.DnsExpectedAnswers = []string{"192.0.2.1"}
+	outcome, err = ProcessCheck(record)
+	if err != nil || outcome.Success {
+		t.Fatalf("expected answers assertion failure, got %v %+v", err, outcome)
+	}
+}
+
+func TestNormaliseAnswers(t *testing.T) {
+	names := normaliseAnswers("CNAME", []string{"Mail.Example.COM."})
+	if names[0] != "mail.example.com" {
+		t.Fatalf("name not normalised: %v", names)
+	}
+	txt := normaliseAnswers("TXT", []string{"Token=AbC."})
+	if txt[0] != "Token=AbC." {
+		t.Fatalf("TXT data altered: %v", txt)
+	}
+}
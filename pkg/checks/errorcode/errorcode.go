@@ -0,0 +1,71 @@
+package errorcode
+
+// Error codes classify why a check failed so failures can be grouped and alerted by cause.
+// WORKERINTERNAL is used for problems on our side (check configuration, worker errors): these are not customer downtime.
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const DNS = "DNS"
+const CONNREFUSED = "CONNREFUSED"
+const TIMEOUT = "TIMEOUT"
+const TLS = "TLS"
+const BADSTATUS = "BADSTATUS"
+const ASSERTION = "ASSERTION"
+
+// redirects stopped by the redirect policy of the check, the target is reachable but it's not sending us where expected
+const REDIRECTLOOP = "REDIRECTLOOP"
+const REDIRECTDOWNGRADE = "REDIRECTDOWNGRADE"
+const REDIRECTMAX = "REDIRECTMAX"
+const REDIRECTHOST = "REDIRECTHOST"
+
+const WORKERINTERNAL = "WORKERINTERNAL"
+
+// INFLIGHTTIMEOUT is used for the requests that never came back (worker crashed, message lost), like WORKERINTERNAL it's on our side
+const INFLIGHTTIMEOUT = "INFLIGHTTIMEOUT"
+
+// NOTEXECUTED is used for the requests the scheduler didn't send (queue backed up) or that expired waiting in the queue
+const NOTEXECUTED = "NOTEXECUTED"
+const OTHER = "OTHER"
+
+// Classify returns the code for errors received while talking to the target, empty string when the error is not recognised
+// dns is checked first since resolution timeouts are still dns problems
+func Classify(err error) string {
+	var dnsErr *net.DNSError
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var netErr net.Error
+
+	if err == nil {
+		return ""
+	}
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return DNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return CONNREFUSED
+	case errors.As(err, &recordHeaderErr),
+		errors.As(err, &unknownAuthorityErr),
+		errors.As(err, &hostnameErr),
+		errors.As(err, &certificateInvalidErr):
+		return TLS
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return TIMEOUT
+	case strings.Contains(err.Error(), "tls: "):
+		// handshake alerts are not exported as types by the go version we use
+		return TLS
+	}
+
+	return ""
+}
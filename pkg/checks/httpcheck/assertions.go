@@ -0,0 +1,166 @@
+package httpcheck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"brainyping/pkg/dbhelper"
+)
+
+// Assertions are evaluated against the response body, all of them are evaluated (even after a failure) so the outcome shows the full picture
+
+const ASSERTIONTYPECONTAINS = "CONTAINS"
+const ASSERTIONTYPENOTCONTAINS = "NOTCONTAINS"
+const ASSERTIONTYPEREGEX = "REGEX"
+const ASSERTIONTYPEJSONPATHEQUALS = "JSONPATHEQUALS"
+const ASSERTIONTYPEJSONPATHEXISTS = "JSONPATHEXISTS"
+
+// readBodyWithCap reads up to maxBytes from the body, the returned flag is true if the body was longer and has been truncated
+func readBodyWithCap(body io.Reader, maxBytes int64) ([]byte, bool, error) {
+	if maxBytes <= 0 {
+		b, err := ioutil.ReadAll(body)
+		return b, false, err
+	}
+	// read one byte more than allowed to know if the body has been truncated
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxBytes+1))
+	if int64(len(b)) > maxBytes {
+		return b[:maxBytes], true, err
+	}
+	return b, false, err
+}
+
+func evaluateAssertions(body []byte, assertions []dbhelper.HttpAssertion) []dbhelper.AssertionResult {
+	var results []dbhelper.AssertionResult
+	var jsonBody interface{}
+	var jsonErr error
+	var jsonParsed bool
+
+	for _, a := range assertions {
+		result := dbhelper.AssertionResult{Type: a.Type, Path: a.Path, Value: a.Value}
+
+		switch a.Type {
+		case ASSERTIONTYPECONTAINS:
+			result.Passed = strings.Contains(string(body), a.Value)
+		case ASSERTIONTYPENOTCONTAINS:
+			result.Passed = !strings.Contains(string(body), a.Value)
+		case ASSERTIONTYPEREGEX:
+			re, err := regexp.Compile(a.Value)
+			if err != nil {
+				result.Error = "regular expression not valid: " + err.Error()
+				break
+			}
+			result.Passed = re.Match(body)
+		case ASSERTIONTYPEJSONPATHEQUALS, ASSERTIONTYPEJSONPATHEXISTS:
+			// the body is parsed only once and only if needed
+			if !jsonParsed {
+				jsonErr = json.Unmarshal(body, &jsonBody)
+				jsonParsed = true
+			}
+			if jsonErr != nil {
+				result.Error = "response body is not valid json: " + jsonErr.Error()
+				break
+			}
+			value, found, err := jsonPathLookup(jsonBody, a.Path)
+			if err != nil {
+				result.Error = err.Error()
+				break
+			}
+			if a.Type == ASSERTIONTYPEJSONPATHEXISTS {
+				result.Passed = found
+				break
+			}
+			if !found {
+				result.Error = fmt.Sprintf("path [%s] not found", a.Path)
+				break
+			}
+			result.Actual = jsonValueToString(value)
+			result.Passed = result.Actual == a.Value
+		default:
+			result.Error = fmt.Sprintf("assertion type [%s] not supported", a.Type)
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func firstFailedAssertion(results []dbhelper.AssertionResult) (dbhelper.AssertionResult, bool) {
+	for _, r := range results {
+		if !r.Passed {
+			return r, true
+		}
+	}
+	return dbhelper.AssertionResult{}, false
+}
+
+func describeAssertionFailure(result dbhelper.AssertionResult) string {
+	var description string
+	switch result.Type {
+	case ASSERTIONTYPEJSONPATHEQUALS:
+		description = fmt.Sprintf("%s [%s] expected [%s] found [%s]", result.Type, result.Path, result.Value, result.Actual)
+	case ASSERTIONTYPEJSONPATHEXISTS:
+		description = fmt.Sprintf("%s [%s]", result.Type, result.Path)
+	default:
+		description = fmt.Sprintf("%s [%s]", result.Type, result.Value)
+	}
+	if result.Error != "" {
+		description = description + ": " + result.Error
+	}
+	return "Assertion failed " + description
+}
+
+// jsonPathLookup walks the decoded json using a simple dotted path, e.g. `$.data.items[0].status` or `data.items.0.status`
+func jsonPathLookup(document interface{}, path string) (interface{}, bool, error) {
+	var current = document
+
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return current, true, nil
+	}
+
+	// brackets are converted to dotted segments so we only need to deal with one syntax
+	path = strings.ReplaceAll(strings.ReplaceAll(path, "[", "."), "]", "")
+
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			return nil, false, errors.New(fmt.Sprintf("json path [%s] not valid", path))
+		}
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, exists := node[segment]
+			if !exists {
+				return nil, false, nil
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil {
+				return nil, false, nil
+			}
+			if index < 0 || index >= len(node) {
+				return nil, false, nil
+			}
+			current = node[index]
+		default:
+			return nil, false, nil
+		}
+	}
+
+	return current, true, nil
+}
+
+// jsonValueToString returns strings as they are and any other value in its json representation
+func jsonValueToString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
@@ -1,32 +1,91 @@
 package httpcheck
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/checks/registry"
 	"brainyping/pkg/dbhelper"
 )
 
 var HttpCheckDefaultUserAgent string
+var HttpCheckDefaultTimeout time.Duration
+var HttpCheckMaxBodyBytes int64 = 1024 * 1024
 
-func ProcessCheck(url string, subType string, userAgent string) (dbhelper.CheckOutcomeRecord, error) {
+const ASSERTIONSTATUSCODE = "STATUSCODE"
+const ASSERTIONRESPONSESTRING = "RESPONSESTRING"
+const ASSERTIONBODY = "BODY"
+const ASSERTIONROBOTSTXTEXISTS = "ROBOTSTXTEXISTS"
+const ASSERTIONROBOTSTXTBLOCKSALL = "ROBOTSTXTBLOCKSALL"
+
+type checker struct{}
+
+func init() {
+	registry.Register(checker{})
+}
+
+func (checker) Type() string {
+	return "HTTP"
+}
+
+func (checker) SubTypes() []string {
+	return []string{"HEAD", "GET", "POST", "PUT", "ROBOTSTXT", "TRANSACTION"}
+}
+
+func (checker) Description() string {
+	return "HTTP(S) request with status code and response content assertions, ROBOTSTXT verifies the host robots.txt, TRANSACTION runs a list of steps"
+}
+
+func (checker) ConfigSchema() []registry.ConfigField {
+	return []registry.ConfigField{
+		{Field: "host", Description: "url to call, including protocol", Required: true},
+		{Field: "useragent", Description: "user agent, worker default used if empty"},
+		{Field: "httpheaders", Description: "list of [name, value] headers"},
+		{Field: "httpbody", Description: "body sent with POST/PUT requests"},
+		{Field: "httpstatuscodeok", Description: "expected status code, any 2xx if empty"},
+		{Field: "responsestring", Description: "string expected in the response body"},
+		{Field: "responsestringisregex", Description: "response string is a regular expression"},
+		{Field: "httpassertions", Description: "list of response body assertions (CONTAINS, NOTCONTAINS, REGEX, JSONPATHEQUALS, JSONPATHEXISTS)"},
+		{Field: "httpsteps", Description: "list of requests performed by TRANSACTION checks, urls can be relative to the host"},
+		{Field: "timeoutms", Description: "request timeout, worker default used if empty"},
+		{Field: "slowthresholdms", Description: "responses slower than this are reported as degraded"},
+		{Field: "httpdontfollowredirects", Description: "redirects are not followed, the 3xx response is verified"},
+		{Field: "httpmaxredirects", Description: "max number of redirects followed, 10 if empty"},
+		{Field: "httpfailonhostchange", Description: "fail if the final url is on a different host"},
+		{Field: "httpfailondowngrade", Description: "fail if a redirect goes from https to http"},
+	}
+}
+
+func (checker) Process(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	return ProcessCheck(record)
+}
+
+func ProcessCheck(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
 	var outcome dbhelper.CheckOutcomeRecord
 	var err error
 
-	switch subType {
-	case "HEAD", "GET":
-		outcome, err = subTypeGetHead(url, subType, userAgent)
+	switch record.SubType {
+	case "HEAD", "GET", "POST", "PUT":
+		outcome, err = subTypeGetHead(record)
 		break
-	// case "HEAD":
-	//	subTypeGetHead(url, "HEAD")
-	//	break
 	case "ROBOTSTXT":
-		outcome, err = subTypeRobotstxt(url)
+		outcome, err = subTypeRobotstxt(record)
+		break
+	case "TRANSACTION":
+		outcome, err = subTypeTransaction(record)
 		break
 	default:
 		err = errors.New("subType subtype not correct")
@@ -35,20 +94,13 @@ func ProcessCheck(url string, subType string, userAgent string) (dbhelper.CheckO
 	return outcome, err
 }
 
-func subTypeGetHead(url string, method string, userAgent string) (dbhelper.CheckOutcomeRecord, error) {
+// subTypeGetHead performs a single http call using the method stored in the check subtype (the name comes from the time we only supported GET/HEAD)
+func subTypeGetHead(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
 	var err error
-	var cookieJar *cookiejar.Jar
-	var client http.Client
-	var request *http.Request
-	var response *http.Response
-	var timeout = 10000 * time.Millisecond
+	var client *http.Client
 	var returnedValue dbhelper.CheckOutcomeRecord
-	var userAgentToUse string
-	var ctx, cancelFunc = context.WithCancel(context.TODO())
-
-	defer cancelFunc()
 
-	cookieJar, err = cookiejar.New(nil)
+	client, err = newHttpClient(record)
 	if err != nil {
 		returnedValue.ErrorInternal = "Error while preparing http cookie jar: " + err.Error()
 		returnedValue.ErrorOriginal = err.Error()
@@ -56,41 +108,99 @@ func subTypeGetHead(url string, method string, userAgent string) (dbhelper.Check
 		returnedValue.Message = returnedValue.ErrorFriendly
 		return returnedValue, err
 	}
-	client = http.Client{
-		Timeout: timeout,
-		Jar:     cookieJar,
+
+	returnedValue, _, _, err = performRequest(client, record)
+
+	return returnedValue, err
+}
+
+// newHttpClient returns a client with its own cookie jar, the jar is shared by all the requests performed with the client
+// timeout and redirect policy come from the check
+func newHttpClient(record dbhelper.CheckRecord) (*http.Client, error) {
+	cookieJar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{
+		Timeout:       timeoutToUse(record),
+		Jar:           cookieJar,
+		CheckRedirect: redirectPolicy(record),
 	}
 
 	client.CloseIdleConnections()
 
-	request, err = http.NewRequest(method, url, nil)
+	return &client, nil
+}
+
+// performRequest performs the http call described by the record and verifies the response
+// the response (with the body already consumed) and the body read are returned to allow the caller to extract information from them
+func performRequest(client *http.Client, record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, *http.Response, []byte, error) {
+	var err error
+	var request *http.Request
+	var response *http.Response
+	var requestBody io.Reader
+	var responseBody []byte
+	var readErr error
+	var timeout = timeoutToUse(record)
+	var returnedValue dbhelper.CheckOutcomeRecord
+	var userAgentToUse string
+	var matched bool
+	var requestStart time.Time
+	var requestDuration time.Duration
+	var timings requestTimings
+	var ctx, cancelFunc = context.WithTimeout(context.Background(), timeout)
+
+	defer cancelFunc()
+
+	// only methods that are expected to carry a payload send the configured body
+	if record.HttpBody != "" && (record.SubType == "POST" || record.SubType == "PUT") {
+		requestBody = strings.NewReader(record.HttpBody)
+	}
+
+	request, err = http.NewRequest(record.SubType, record.Host, requestBody)
 	if err != nil {
 		returnedValue.ErrorInternal = "Error while preparing http request: " + err.Error()
 		returnedValue.ErrorOriginal = err.Error()
 		returnedValue.ErrorFriendly = "Error while preparing HTTP request"
 		returnedValue.Message = returnedValue.ErrorFriendly
-		return returnedValue, err
+		return returnedValue, nil, nil, err
 	}
 	request.Close = true
-	request.WithContext(ctx)
+	request = request.WithContext(httptrace.WithClientTrace(ctx, timings.clientTrace()))
 
-	if userAgent != "" {
-		userAgentToUse = userAgent
+	if record.UserAgent != "" {
+		userAgentToUse = record.UserAgent
 	} else {
 		userAgentToUse = HttpCheckDefaultUserAgent
 	}
 
 	request.Header.Set("User-Agent", userAgentToUse)
 
+	// custom headers are applied after the user agent so they can override it if needed
+	err = applyHeaders(request, record.HttpHeaders)
+	if err != nil {
+		returnedValue.ErrorInternal = "Error while preparing http request headers: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = "Error while preparing HTTP request headers"
+		returnedValue.Message = returnedValue.ErrorFriendly
+		return returnedValue, nil, nil, err
+	}
+
+	requestStart = time.Now()
 	response, err = client.Do(request)
+	timings.copyToOutcome(&returnedValue)
 
 	if err != nil {
+		if redirectPolicyFailed(&returnedValue, response, err) {
+			return returnedValue, nil, nil, nil
+		}
 		returnedValue.ErrorInternal = "Error while performing http call: " + err.Error()
 		returnedValue.ErrorOriginal = err.Error()
 		returnedValue.Message = returnedValue.ErrorFriendly
-		returnedValue.ErrorFriendly = returnedValue.ErrorInternal // todo try to detect errors due to the target server vs internal app errors
-		// for the moments all http errors are considered errors to expose to the customers so returned error is nil
-		return returnedValue, nil
+		returnedValue.ErrorFriendly = returnedValue.ErrorInternal
+		returnedValue.ErrorCode = errorcode.Classify(err)
+		// http errors are exposed to the customers so returned error is nil, the error code tells what went wrong
+		return returnedValue, nil, nil, nil
 	}
 
 	defer response.Body.Close()
@@ -98,24 +208,299 @@ func subTypeGetHead(url string, method string, userAgent string) (dbhelper.Check
 
 	returnedValue.Message = fmt.Sprintf("%s ||%d", response.Status, response.StatusCode)
 	returnedValue.ContentLength = response.ContentLength
-	if returnedValue.ContentLength < 1 {
-		b, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			// todo log error
+
+	// client.Do returns once the headers are received, what is left is the body transfer
+	transferStart := time.Now()
+	responseBody, returnedValue.BodyTruncated, readErr = readBodyWithCap(response.Body, HttpCheckMaxBodyBytes)
+	returnedValue.TransferTime = time.Since(transferStart).Microseconds()
+	if readErr != nil {
+		// todo log error
+		if returnedValue.ContentLength < 1 {
 			returnedValue.ContentLength = -2 // -2 is our way to expose the content length not found
+		}
+	} else if returnedValue.ContentLength < 1 {
+		returnedValue.ContentLength = int64(len(responseBody))
+	}
+	requestDuration = time.Since(requestStart)
+
+	redirectionsToListRecursive(response, &returnedValue.RedirectsHistory)
+	returnedValue.Redirects = len(returnedValue.RedirectsHistory)
+
+	if record.HttpFailOnHostChange && finalHostChanged(response, request) {
+		returnedValue.ErrorOriginal = fmt.Sprintf("Redirected to %s, outside the original host %s", response.Request.URL.Host, request.URL.Host)
+		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+		returnedValue.FailedAssertion = ASSERTIONREDIRECTHOST
+		returnedValue.ErrorCode = errorcode.REDIRECTHOST
+		return returnedValue, response, responseBody, nil
+	}
+
+	if !statusCodeIsOk(response.StatusCode, record.HttpStatusCodeOK) {
+		if record.HttpStatusCodeOK == 0 {
+			returnedValue.ErrorOriginal = fmt.Sprintf("Status code not 2xx but %s", response.Status)
 		} else {
-			returnedValue.ContentLength = int64(len(b))
+			returnedValue.ErrorOriginal = fmt.Sprintf("Status code not %d but %s", record.HttpStatusCodeOK, response.Status)
+		}
+		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+		returnedValue.FailedAssertion = ASSERTIONSTATUSCODE
+		// this situation while is a failed check is not an app error so returned err is nil
+		return returnedValue, response, responseBody, nil
+	}
+
+	if record.ResponseString != "" {
+		if readErr != nil {
+			// we were not able to read the body so we cannot verify its content
+			returnedValue.ErrorOriginal = readErr.Error()
+			returnedValue.ErrorInternal = "Error while reading http response body: " + readErr.Error()
+			returnedValue.ErrorFriendly = "Unable to read the response body to look for the expected content"
+			returnedValue.FailedAssertion = ASSERTIONRESPONSESTRING
+			return returnedValue, response, responseBody, nil
+		}
+		matched, err = responseStringMatches(responseBody, record.ResponseString, record.ResponseStringIsRegex)
+		if err != nil {
+			// a regex that doesn't compile is a check configuration problem, not something the target did
+			returnedValue.ErrorInternal = "Error while preparing response string regex: " + err.Error()
+			returnedValue.ErrorOriginal = err.Error()
+			returnedValue.ErrorFriendly = "Response string regular expression not valid"
+			returnedValue.FailedAssertion = ASSERTIONRESPONSESTRING
+			return returnedValue, response, responseBody, err
+		}
+		if !matched {
+			if record.ResponseStringIsRegex {
+				returnedValue.ErrorOriginal = fmt.Sprintf("Response body does not match regex [%s]", record.ResponseString)
+			} else {
+				returnedValue.ErrorOriginal = fmt.Sprintf("Response body does not contain [%s]", record.ResponseString)
+			}
+			returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+			returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+			returnedValue.FailedAssertion = ASSERTIONRESPONSESTRING
+			return returnedValue, response, responseBody, nil
+		}
+	}
+
+	if len(record.HttpAssertions) > 0 {
+		if readErr != nil {
+			returnedValue.ErrorOriginal = readErr.Error()
+			returnedValue.ErrorInternal = "Error while reading http response body: " + readErr.Error()
+			returnedValue.ErrorFriendly = "Unable to read the response body to verify the assertions"
+			returnedValue.FailedAssertion = ASSERTIONBODY
+			return returnedValue, response, responseBody, nil
+		}
+		returnedValue.AssertionsResults = evaluateAssertions(responseBody, record.HttpAssertions)
+		if failed, found := firstFailedAssertion(returnedValue.AssertionsResults); found {
+			returnedValue.ErrorOriginal = describeAssertionFailure(failed)
+			if returnedValue.BodyTruncated {
+				returnedValue.ErrorOriginal = returnedValue.ErrorOriginal + fmt.Sprintf(" (body truncated at %d bytes)", HttpCheckMaxBodyBytes)
+			}
+			returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+			returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+			returnedValue.FailedAssertion = ASSERTIONBODY
+			return returnedValue, response, responseBody, nil
+		}
+	}
+
+	// a slow response is still a successful one but we want to flag it
+	if record.SlowThresholdMs > 0 && requestDuration > time.Duration(record.SlowThresholdMs)*time.Millisecond {
+		returnedValue.Degraded = true
+		returnedValue.Message = fmt.Sprintf("%s (slow response %dms, threshold %dms)", returnedValue.Message, requestDuration.Milliseconds(), record.SlowThresholdMs)
+	}
+
+	returnedValue.Success = true
+
+	return returnedValue, response, responseBody, nil
+}
+
+// requestTimings collects the time spent in each phase of an http call using the client trace hooks
+// when redirects are followed each phase is the sum of the time spent in that phase by each request
+type requestTimings struct {
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wroteRequest time.Time
+	dns          time.Duration
+	connect      time.Duration
+	tls          time.Duration
+	ttfb         time.Duration
+}
+
+func (rt *requestTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(_ httptrace.DNSStartInfo) { rt.dnsStart = time.Now() },
+		DNSDone: func(_ httptrace.DNSDoneInfo) {
+			if !rt.dnsStart.IsZero() {
+				rt.dns += time.Since(rt.dnsStart)
+			}
+		},
+		ConnectStart: func(_, _ string) { rt.connectStart = time.Now() },
+		ConnectDone: func(_, _ string, _ error) {
+			if !rt.connectStart.IsZero() {
+				rt.connect += time.Since(rt.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() { rt.tlsStart = time.Now() },
+		TLSHandshakeDone: func(_ tls.ConnectionState, _ error) {
+			if !rt.tlsStart.IsZero() {
+				rt.tls += time.Since(rt.tlsStart)
+			}
+		},
+		WroteRequest: func(_ httptrace.WroteRequestInfo) { rt.wroteRequest = time.Now() },
+		GotFirstResponseByte: func() {
+			if !rt.wroteRequest.IsZero() {
+				rt.ttfb += time.Since(rt.wroteRequest)
+			}
+		},
+	}
+}
+
+func (rt *requestTimings) copyToOutcome(outcome *dbhelper.CheckOutcomeRecord) {
+	outcome.DnsTime = rt.dns.Microseconds()
+	outcome.ConnectTime = rt.connect.Microseconds()
+	outcome.TlsHandshakeTime = rt.tls.Microseconds()
+	outcome.TtfbTime = rt.ttfb.Microseconds()
+}
+
+// timeoutToUse returns the check timeout if configured, otherwise the worker default one
+func timeoutToUse(record dbhelper.CheckRecord) time.Duration {
+	if record.TimeoutMs > 0 {
+		return time.Duration(record.TimeoutMs) * time.Millisecond
+	}
+	if HttpCheckDefaultTimeout > 0 {
+		return HttpCheckDefaultTimeout
+	}
+	return 10000 * time.Millisecond
+}
+
+// applyHeaders adds the check custom headers to the request, each header is a [name, value] pair
+func applyHeaders(request *http.Request, headers [][]string) error {
+	for _, h := range headers {
+		if len(h) != 2 || strings.Trim(h[0], " ") == "" {
+			return errors.New(fmt.Sprintf("header %v not valid, expected a name/value pair", h))
 		}
+		// the host header is not sent from the headers map by the http client, it needs to be set on the request itself
+		if strings.EqualFold(h[0], "Host") {
+			request.Host = h[1]
+			continue
+		}
+		request.Header.Set(h[0], h[1])
+	}
+	return nil
+}
+
+// statusCodeIsOk verifies the status code received, if no expected status code is configured any 2xx is considered ok
+func statusCodeIsOk(statusCode int, expectedStatusCode int) bool {
+	if expectedStatusCode == 0 {
+		return statusCode >= 200 && statusCode < 300
+	}
+	return statusCode == expectedStatusCode
+}
+
+func responseStringMatches(body []byte, responseString string, isRegex bool) (bool, error) {
+	if !isRegex {
+		return bytes.Contains(body, []byte(responseString)), nil
+	}
+	re, err := regexp.Compile(responseString)
+	if err != nil {
+		return false, err
+	}
+	return re.Match(body), nil
+}
+
+// subTypeRobotstxt fetches the robots.txt of the check host and verifies it exists and it is not blocking the whole website
+// the content hash is compared by the response collector with the one of the previous run to detect changes
+func subTypeRobotstxt(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	var err error
+	var client http.Client
+	var request *http.Request
+	var response *http.Response
+	var robotsUrl *url.URL
+	var body []byte
+	var timeout = timeoutToUse(record)
+	var returnedValue dbhelper.CheckOutcomeRecord
+	var userAgentToUse string
+
+	robotsUrl, err = url.Parse(record.Host)
+	if err != nil {
+		returnedValue.ErrorInternal = "Error while preparing robots.txt url: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = "Error while preparing robots.txt url"
+		returnedValue.Message = returnedValue.ErrorFriendly
+		return returnedValue, err
+	}
+	// robots.txt always lives in the root of the host, whatever path was configured in the check
+	robotsUrl.Path = "/robots.txt"
+	robotsUrl.RawQuery = ""
+	robotsUrl.Fragment = ""
+
+	client = http.Client{
+		Timeout:       timeout,
+		CheckRedirect: redirectPolicy(record),
 	}
 
+	request, err = http.NewRequest("GET", robotsUrl.String(), nil)
+	if err != nil {
+		returnedValue.ErrorInternal = "Error while preparing http request: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = "Error while preparing HTTP request"
+		returnedValue.Message = returnedValue.ErrorFriendly
+		return returnedValue, err
+	}
+	request.Close = true
+
+	if record.UserAgent != "" {
+		userAgentToUse = record.UserAgent
+	} else {
+		userAgentToUse = HttpCheckDefaultUserAgent
+	}
+	request.Header.Set("User-Agent", userAgentToUse)
+
+	response, err = client.Do(request)
+	if err != nil {
+		if redirectPolicyFailed(&returnedValue, response, err) {
+			return returnedValue, nil
+		}
+		returnedValue.ErrorInternal = "Error while performing http call: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = returnedValue.ErrorInternal
+		returnedValue.Message = returnedValue.ErrorFriendly
+		returnedValue.ErrorCode = errorcode.Classify(err)
+		return returnedValue, nil
+	}
+	defer response.Body.Close()
+
+	returnedValue.Message = fmt.Sprintf("%s ||%d", response.Status, response.StatusCode)
 	redirectionsToListRecursive(response, &returnedValue.RedirectsHistory)
 	returnedValue.Redirects = len(returnedValue.RedirectsHistory)
 
 	if response.StatusCode < 200 || response.StatusCode >= 300 {
-		returnedValue.ErrorOriginal = fmt.Sprintf("Status code not 2xx but %s", response.Status)
+		returnedValue.ErrorOriginal = fmt.Sprintf("robots.txt not found, status code not 2xx but %s", response.Status)
 		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
 		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
-		// this situation while is a failed check is not an app error so returned err is nil
+		returnedValue.FailedAssertion = ASSERTIONROBOTSTXTEXISTS
+		return returnedValue, nil
+	}
+
+	// a huge robots.txt (or something else served as robots.txt) must not exhaust the worker memory
+	body, returnedValue.BodyTruncated, err = readBodyWithCap(response.Body, HttpCheckMaxBodyBytes)
+	if err != nil {
+		returnedValue.ErrorInternal = "Error while reading robots.txt: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = returnedValue.ErrorInternal
+		returnedValue.Message = returnedValue.ErrorFriendly
+		returnedValue.ErrorCode = errorcode.Classify(err)
+		return returnedValue, nil
+	}
+
+	returnedValue.RobotsTxtExists = true
+	returnedValue.ContentLength = int64(len(body))
+	returnedValue.RobotsTxtHash = fmt.Sprintf("%x", sha256.Sum256(body))
+	returnedValue.RobotsTxtBlocksAll = robotsTxtBlocksAll(body)
+
+	if returnedValue.RobotsTxtBlocksAll {
+		returnedValue.ErrorOriginal = "robots.txt is disallowing the whole website to all user agents"
+		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+		returnedValue.FailedAssertion = ASSERTIONROBOTSTXTBLOCKSALL
 		return returnedValue, nil
 	}
 
@@ -124,20 +509,54 @@ func subTypeGetHead(url string, method string, userAgent string) (dbhelper.Check
 	return returnedValue, nil
 }
 
-func subTypeRobotstxt(url string) (dbhelper.CheckOutcomeRecord, error) {
-	return dbhelper.CheckOutcomeRecord{}, nil
-	// timeout := time.Duration(3 * time.Second)
-	// client := http.Client{
-	//	Timeout: timeout,
-	// }
-	// resp, err := client.Head(url)
-	// if err != nil {
-	//	return false, err
-	// }
-	// if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-	//	return false, errors.New(fmt.Sprintf("Status code returner not 2xx but %d", resp.StatusCode))
-	// }
-	// return true, nil
+// robotsTxtBlocksAll looks for a `Disallow: /` rule in the group of rules for all user agents (`*`)
+// a group that also contains an allow rule is not considered to block everything
+func robotsTxtBlocksAll(body []byte) bool {
+	var groupForAll bool
+	var previousWasUserAgent bool
+	var disallowAll bool
+	var allowSomething bool
+
+	for _, line := range strings.Split(string(body), "\n") {
+		// remove comments and spaces
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		field := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+
+		switch field {
+		case "user-agent":
+			// consecutive user-agent lines share the same group of rules
+			if !previousWasUserAgent {
+				groupForAll = false
+			}
+			if value == "*" {
+				groupForAll = true
+			}
+			previousWasUserAgent = true
+			continue
+		case "disallow":
+			if groupForAll && value == "/" {
+				disallowAll = true
+			}
+		case "allow":
+			if groupForAll && value != "" {
+				allowSomething = true
+			}
+		}
+		previousWasUserAgent = false
+	}
+
+	return disallowAll && !allowSomething
 }
 
 func redirectionsToListRecursive(resp *http.Response, history *[]dbhelper.RedirectHistory) {
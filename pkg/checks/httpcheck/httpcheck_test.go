@@ -0,0 +1,99 @@
+package httpcheck
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/dbhelper"
+)
+
+func TestRobotsTxtBodyIsCapped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("User-agent: *\nDisallow: /private\n" + strings.Repeat("# padding\n", 1000)))
+	}))
+	defer server.Close()
+
+	defer func(maxBodyBytes int64) { HttpCheckMaxBodyBytes = maxBodyBytes }(HttpCheckMaxBodyBytes)
+	HttpCheckMaxBodyBytes = 100
+
+	outcome, err := ProcessCheck(dbhelper.CheckRecord{CheckId: "check1", Host: server.URL + "/some/page", Type: "HTTP", SubType: "ROBOTSTXT"})
+	if err != nil || !outcome.Success {
+		t.Fatalf("expected success, got %v %+v", err, outcome)
+	}
+	if !outcome.BodyTruncated || outcome.ContentLength != 100 {
+		t.Fatalf("expected the body to be truncated at 100 bytes, got %t %d", outcome.BodyTruncated, outcome.ContentLength)
+	}
+	if outcome.RobotsTxtHash == "" || outcome.RobotsTxtChanged {
+		t.Fatalf("expected a hash and no change detected by the worker, got %q %t", outcome.RobotsTxtHash, outcome.RobotsTxtChanged)
+	}
+}
+
+func TestRobotsTxtBodyReadFailureIsClassified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("User-agent: *\n"))
+		w.(http.Flusher).Flush()
+		// the rest of the body never arrives in time
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	outcome, err := ProcessCheck(dbhelper.CheckRecord{CheckId: "check1", Host: server.URL, Type: "HTTP", SubType: "ROBOTSTXT", TimeoutMs: 200})
+	if err != nil || outcome.Success {
+		t.Fatalf("expected a failure, got %v %+v", err, outcome)
+	}
+	if outcome.ErrorCode != errorcode.TIMEOUT {
+		t.Fatalf("expected error code %s, got %q (%s)", errorcode.TIMEOUT, outcome.ErrorCode, outcome.ErrorOriginal)
+	}
+}
+
+func TestRedirectPolicyFailuresHaveTheirOwnErrorCode(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/chain":
+			http.Redirect(w, r, "/chain?"+r.URL.RawQuery+"x", http.StatusFound)
+		case "/elsewhere":
+			// same server, reached through another host name
+			http.Redirect(w, r, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)+"/ok", http.StatusFound)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path      string
+		record    dbhelper.CheckRecord
+		assertion string
+		errorCode string
+	}{
+		{"/loop", dbhelper.CheckRecord{}, ASSERTIONREDIRECTLOOP, errorcode.REDIRECTLOOP},
+		{"/chain", dbhelper.CheckRecord{HttpMaxRedirects: 2}, ASSERTIONREDIRECTMAX, errorcode.REDIRECTMAX},
+		{"/elsewhere", dbhelper.CheckRecord{HttpFailOnHostChange: true}, ASSERTIONREDIRECTHOST, errorcode.REDIRECTHOST},
+	}
+	for _, test := range tests {
+		record := test.record
+		record.CheckId = "check1"
+		record.Host = server.URL + test.path
+		record.Type = "HTTP"
+		record.SubType = "GET"
+
+		outcome, err := ProcessCheck(record)
+		if err != nil || outcome.Success {
+			t.Fatalf("%s: expected a failure, got %v %+v", test.path, err, outcome)
+		}
+		if outcome.FailedAssertion != test.assertion || outcome.ErrorCode != test.errorCode {
+			t.Fatalf("%s: expected %s %s, got %s %s", test.path, test.assertion, test.errorCode, outcome.FailedAssertion, outcome.ErrorCode)
+		}
+	}
+}
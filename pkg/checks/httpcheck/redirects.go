@@ -0,0 +1,93 @@
+package httpcheck
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/dbhelper"
+)
+
+const ASSERTIONREDIRECTLOOP = "REDIRECTLOOP"
+const ASSERTIONREDIRECTDOWNGRADE = "REDIRECTDOWNGRADE"
+const ASSERTIONREDIRECTMAX = "REDIRECTMAX"
+const ASSERTIONREDIRECTHOST = "REDIRECTHOST"
+
+// same limit used by the go http client when no policy is set
+const defaultMaxRedirects = 10
+
+// redirectError is returned by the redirect policy to stop the client, code ends up in the outcome FailedAssertion
+// and errorCode in the outcome ErrorCode
+type redirectError struct {
+	code      string
+	errorCode string
+	message   string
+}
+
+func (e redirectError) Error() string {
+	return e.message
+}
+
+// redirectPolicy returns the CheckRedirect function applying the redirect options of the check
+// via has the requests already performed, the oldest first, req is the one about to be performed
+func redirectPolicy(record dbhelper.CheckRecord) func(req *http.Request, via []*http.Request) error {
+	var maxRedirects = record.HttpMaxRedirects
+
+	if maxRedirects <= 0 {
+		maxRedirects = defaultMaxRedirects
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		if record.HttpDontFollowRedirects {
+			// the 3xx response is returned as it is and verified like any other response
+			return http.ErrUseLastResponse
+		}
+
+		for _, previous := range via {
+			if previous.URL.String() == req.URL.String() {
+				return redirectError{code: ASSERTIONREDIRECTLOOP, errorCode: errorcode.REDIRECTLOOP, message: fmt.Sprintf("Redirect loop detected, %s already visited", req.URL.String())}
+			}
+		}
+
+		last := via[len(via)-1]
+		if record.HttpFailOnDowngrade && strings.EqualFold(last.URL.Scheme, "https") && strings.EqualFold(req.URL.Scheme, "http") {
+			return redirectError{code: ASSERTIONREDIRECTDOWNGRADE, errorCode: errorcode.REDIRECTDOWNGRADE, message: fmt.Sprintf("Redirect from https to http, %s redirected to %s", last.URL.String(), req.URL.String())}
+		}
+
+		if len(via) > maxRedirects {
+			return redirectError{code: ASSERTIONREDIRECTMAX, errorCode: errorcode.REDIRECTMAX, message: fmt.Sprintf("Stopped after %d redirects", maxRedirects)}
+		}
+
+		return nil
+	}
+}
+
+// redirectPolicyFailed fills the outcome when the client was stopped by the redirect policy
+// the response, if any, is the last one received and is used to record the redirects history
+func redirectPolicyFailed(returnedValue *dbhelper.CheckOutcomeRecord, response *http.Response, err error) bool {
+	var redirectErr redirectError
+
+	if !errors.As(err, &redirectErr) {
+		return false
+	}
+
+	if response != nil {
+		redirectionsToListRecursive(response, &returnedValue.RedirectsHistory)
+		returnedValue.Redirects = len(returnedValue.RedirectsHistory)
+	}
+	returnedValue.ErrorOriginal = redirectErr.message
+	returnedValue.ErrorInternal = redirectErr.message
+	returnedValue.ErrorFriendly = redirectErr.message
+	returnedValue.Message = redirectErr.message
+	returnedValue.FailedAssertion = redirectErr.code
+	returnedValue.ErrorCode = redirectErr.errorCode
+
+	return true
+}
+
+// finalHostChanged verifies the host of the last request is the same of the first one, the port is ignored
+func finalHostChanged(response *http.Response, originalRequest *http.Request) bool {
+	return !strings.EqualFold(response.Request.URL.Hostname(), originalRequest.URL.Hostname())
+}
@@ -0,0 +1,238 @@
+package httpcheck
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"brainyping/pkg/dbhelper"
+)
+
+// A transaction is an ordered list of http steps sharing the same client (and cookie jar).
+// Each step can extract values from its response and the following steps can use them with the {{name}} placeholder
+// in the url, headers and body. The transaction stops at the first step failing.
+
+const ASSERTIONEXTRACTION = "EXTRACTION"
+
+const EXTRACTIONSOURCEHEADER = "HEADER"
+const EXTRACTIONSOURCECOOKIE = "COOKIE"
+const EXTRACTIONSOURCEJSONPATH = "JSONPATH"
+
+func subTypeTransaction(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	var err error
+	var client *http.Client
+	var returnedValue dbhelper.CheckOutcomeRecord
+	var variables = map[string]string{}
+	var stepRecord dbhelper.CheckRecord
+	var stepOutcome dbhelper.CheckOutcomeRecord
+	var stepResult dbhelper.HttpStepResult
+	var response *http.Response
+	var body []byte
+	var stepStart time.Time
+	var slowSteps []string
+
+	if len(record.HttpSteps) == 0 {
+		err = errors.New("transaction has no steps")
+		returnedValue.ErrorInternal = "Error while preparing http transaction: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = "Transaction has no steps configured"
+		returnedValue.Message = returnedValue.ErrorFriendly
+		return returnedValue, err
+	}
+
+	client, err = newHttpClient(record)
+	if err != nil {
+		returnedValue.ErrorInternal = "Error while preparing http cookie jar: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = "Error while preparing HTTP cookie jar for request"
+		returnedValue.Message = returnedValue.ErrorFriendly
+		return returnedValue, err
+	}
+
+	for i, step := range record.HttpSteps {
+		stepRecord, err = buildStepRecord(record, step, variables)
+		if err != nil {
+			returnedValue.ErrorInternal = fmt.Sprintf("Error while preparing step %d [%s]: %s", i+1, step.Name, err.Error())
+			returnedValue.ErrorOriginal = err.Error()
+			returnedValue.ErrorFriendly = fmt.Sprintf("Error while preparing step %d [%s]", i+1, step.Name)
+			returnedValue.Message = returnedValue.ErrorFriendly
+			returnedValue.FailedStep = i + 1
+			return returnedValue, err
+		}
+
+		stepStart = time.Now()
+		stepOutcome, response, body, err = performRequest(client, stepRecord)
+
+		stepResult = dbhelper.HttpStepResult{
+			Name:              step.Name,
+			Method:            stepRecord.SubType,
+			URL:               stepRecord.Host,
+			Success:           stepOutcome.Success,
+			TimeSpent:         time.Since(stepStart).Microseconds(),
+			DnsTime:           stepOutcome.DnsTime,
+			ConnectTime:       stepOutcome.ConnectTime,
+			TlsHandshakeTime:  stepOutcome.TlsHandshakeTime,
+			TtfbTime:          stepOutcome.TtfbTime,
+			TransferTime:      stepOutcome.TransferTime,
+			FailedAssertion:   stepOutcome.FailedAssertion,
+			Error:             stepOutcome.ErrorOriginal,
+			AssertionsResults: stepOutcome.AssertionsResults,
+		}
+		if response != nil {
+			stepResult.StatusCode = response.StatusCode
+		}
+
+		// values are extracted only from successful steps, a missing value fails the step because the next ones would not work anyway
+		if stepOutcome.Success {
+			extractErr := extractStepValues(client, response, body, step.Extract, variables)
+			if extractErr != nil {
+				stepOutcome.Success = false
+				stepOutcome.ErrorOriginal = extractErr.Error()
+				stepOutcome.ErrorInternal = stepOutcome.ErrorOriginal
+				stepOutcome.ErrorFriendly = stepOutcome.ErrorOriginal
+				stepOutcome.FailedAssertion = ASSERTIONEXTRACTION
+				stepResult.Success = false
+				stepResult.Error = stepOutcome.ErrorOriginal
+				stepResult.FailedAssertion = ASSERTIONEXTRACTION
+			}
+		}
+
+		returnedValue.StepsResults = append(returnedValue.StepsResults, stepResult)
+		returnedValue.DnsTime += stepOutcome.DnsTime
+		returnedValue.ConnectTime += stepOutcome.ConnectTime
+		returnedValue.TlsHandshakeTime += stepOutcome.TlsHandshakeTime
+		returnedValue.TtfbTime += stepOutcome.TtfbTime
+		returnedValue.TransferTime += stepOutcome.TransferTime
+		returnedValue.RedirectsHistory = append(returnedValue.RedirectsHistory, stepOutcome.RedirectsHistory...)
+		returnedValue.Redirects = len(returnedValue.RedirectsHistory)
+		if stepOutcome.Degraded {
+			slowSteps = append(slowSteps, fmt.Sprintf("%d [%s]", i+1, step.Name))
+		}
+
+		if err != nil || !stepOutcome.Success {
+			returnedValue.FailedStep = i + 1
+			returnedValue.FailedAssertion = stepOutcome.FailedAssertion
+			returnedValue.ErrorCode = stepOutcome.ErrorCode
+			returnedValue.ErrorOriginal = stepOutcome.ErrorOriginal
+			returnedValue.ErrorInternal = fmt.Sprintf("Step %d [%s] failed: %s", i+1, step.Name, stepOutcome.ErrorInternal)
+			returnedValue.ErrorFriendly = fmt.Sprintf("Step %d [%s] failed: %s", i+1, step.Name, stepOutcome.ErrorFriendly)
+			returnedValue.Message = returnedValue.ErrorFriendly
+			return returnedValue, err
+		}
+	}
+
+	returnedValue.Message = fmt.Sprintf("%d steps completed", len(record.HttpSteps))
+	// like a single request, a transaction with slow steps is still successful but flagged
+	if len(slowSteps) > 0 {
+		returnedValue.Degraded = true
+		returnedValue.Message = fmt.Sprintf("%s (slow steps %s, threshold %dms)", returnedValue.Message, strings.Join(slowSteps, ", "), record.SlowThresholdMs)
+	}
+	returnedValue.Success = true
+
+	return returnedValue, nil
+}
+
+// buildStepRecord prepares a check record for the step, the step url can be relative to the check host
+// the options not available on the step (timeout, slow threshold, redirects) are the ones of the check
+func buildStepRecord(record dbhelper.CheckRecord, step dbhelper.HttpStep, variables map[string]string) (dbhelper.CheckRecord, error) {
+	var headers [][]string
+
+	baseUrl, err := url.Parse(record.Host)
+	if err != nil {
+		return dbhelper.CheckRecord{}, err
+	}
+	stepUrl, err := url.Parse(replaceVariables(step.Url, variables))
+	if err != nil {
+		return dbhelper.CheckRecord{}, err
+	}
+
+	for _, h := range step.HttpHeaders {
+		var header []string
+		for _, v := range h {
+			header = append(header, replaceVariables(v, variables))
+		}
+		headers = append(headers, header)
+	}
+
+	method := strings.ToUpper(step.Method)
+	if method == "" {
+		method = "GET"
+	}
+
+	return dbhelper.CheckRecord{
+		CheckId:                 record.CheckId,
+		Type:                    record.Type,
+		SubType:                 method,
+		Host:                    baseUrl.ResolveReference(stepUrl).String(),
+		UserAgent:               record.UserAgent,
+		HttpHeaders:             headers,
+		HttpBody:                replaceVariables(step.HttpBody, variables),
+		HttpStatusCodeOK:        step.HttpStatusCodeOK,
+		HttpAssertions:          step.HttpAssertions,
+		TimeoutMs:               record.TimeoutMs,
+		SlowThresholdMs:         record.SlowThresholdMs,
+		HttpDontFollowRedirects: record.HttpDontFollowRedirects,
+		HttpMaxRedirects:        record.HttpMaxRedirects,
+		HttpFailOnHostChange:    record.HttpFailOnHostChange,
+		HttpFailOnDowngrade:     record.HttpFailOnDowngrade,
+	}, nil
+}
+
+func replaceVariables(text string, variables map[string]string) string {
+	for k, v := range variables {
+		text = strings.ReplaceAll(text, "{{"+k+"}}", v)
+	}
+	return text
+}
+
+func extractStepValues(client *http.Client, response *http.Response, body []byte, extractions []dbhelper.HttpStepExtraction, variables map[string]string) error {
+	var jsonBody interface{}
+	var jsonParsed bool
+
+	for _, e := range extractions {
+		var value string
+		var found bool
+
+		switch strings.ToUpper(e.Source) {
+		case EXTRACTIONSOURCEHEADER:
+			value = response.Header.Get(e.Key)
+			found = value != ""
+		case EXTRACTIONSOURCECOOKIE:
+			// the jar has all the cookies received so far for the url, including the ones set during redirects
+			for _, c := range client.Jar.Cookies(response.Request.URL) {
+				if c.Name == e.Key {
+					value = c.Value
+					found = true
+				}
+			}
+		case EXTRACTIONSOURCEJSONPATH:
+			if !jsonParsed {
+				if err := json.Unmarshal(body, &jsonBody); err != nil {
+					return errors.New("unable to extract values, response body is not valid json: " + err.Error())
+				}
+				jsonParsed = true
+			}
+			v, exists, err := jsonPathLookup(jsonBody, e.Key)
+			if err != nil {
+				return err
+			}
+			if exists {
+				value = jsonValueToString(v)
+				found = true
+			}
+		default:
+			return errors.New(fmt.Sprintf("extraction source [%s] not supported", e.Source))
+		}
+
+		if !found {
+			return errors.New(fmt.Sprintf("value for [%s] not found in %s [%s]", e.Name, e.Source, e.Key))
+		}
+		variables[e.Name] = value
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package httpcheck
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/dbhelper"
+)
+
+func transactionRecord(host string, steps ...dbhelper.HttpStep) dbhelper.CheckRecord {
+	return dbhelper.CheckRecord{CheckId: "check1", Host: host, Type: "HTTP", SubType: "TRANSACTION", HttpSteps: steps}
+}
+
+func TestTransactionStepsFlaggedSlow(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	record := transactionRecord(server.URL, dbhelper.HttpStep{Name: "home", Url: "/"}, dbhelper.HttpStep{Name: "report", Url: "/slow"})
+	record.SlowThresholdMs = 20
+
+	outcome, err := ProcessCheck(record)
+	if err != nil || !outcome.Success {
+		t.Fatalf("expected success, got %v %+v", err, outcome)
+	}
+	if !outcome.Degraded || !strings.Contains(outcome.Message, "2 [report]") || strings.Contains(outcome.Message, "1 [home]") {
+		t.Fatalf("expected only the second step flagged slow, got %t %q", outcome.Degraded, outcome.Message)
+	}
+}
+
+func TestTransactionStepsFailOnHostChange(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			// same server, reached through another host name
+			http.Redirect(w, r, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)+"/", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	record := transactionRecord(server.URL, dbhelper.HttpStep{Name: "home", Url: "/"}, dbhelper.HttpStep{Name: "login", Url: "/login"})
+	record.HttpFailOnHostChange = true
+
+	outcome, err := ProcessCheck(record)
+	if err != nil || outcome.Success {
+		t.Fatalf("expected a failure, got %v %+v", err, outcome)
+	}
+	if outcome.FailedStep != 2 || outcome.FailedAssertion != ASSERTIONREDIRECTHOST || outcome.ErrorCode != errorcode.REDIRECTHOST {
+		t.Fatalf("expected step 2 failed on host change, got %d %s %s", outcome.FailedStep, outcome.FailedAssertion, outcome.ErrorCode)
+	}
+}
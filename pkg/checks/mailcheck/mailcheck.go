@@ -0,0 +1,390 @@
+package mailcheck
+
+// Mail checks connect to the server, read the greeting banner and ask for the capabilities (EHLO for smtp, CAPABILITY for imap,
+// CAPA for pop3). When requested the connection is upgraded with STARTTLS (STLS for pop3) and the capabilities are read again
+// over tls. No authentication is performed.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/checks/registry"
+	"brainyping/pkg/dbhelper"
+)
+
+const ASSERTIONBANNER = "MAILBANNER"
+const ASSERTIONREPLYCODE = "MAILREPLYCODE"
+const ASSERTIONSTARTTLS = "MAILSTARTTLS"
+
+const defaultTimeoutMs = 10000
+const defaultEhloDomain = "brainyping.local"
+
+// certificate authorities used to verify the server after STARTTLS, nil uses the ones of the system
+var rootCAs *x509.CertPool
+
+type checker struct{}
+
+func init() {
+	registry.Register(checker{})
+}
+
+func (checker) Type() string {
+	return "MAIL"
+}
+
+func (checker) SubTypes() []string {
+	return []string{"SMTP", "IMAP", "POP3"}
+}
+
+func (checker) Description() string {
+	return "Reads the greeting banner and the capabilities of a mail server, optionally upgrading with STARTTLS"
+}
+
+func (checker) ConfigSchema() []registry.ConfigField {
+	return []registry.ConfigField{
+		{Field: "host", Description: "host name or ip address", Required: true},
+		{Field: "port", Description: "tcp port", Required: true},
+		{Field: "mailstarttls", Description: "upgrade the connection with STARTTLS"},
+		{Field: "mailehlodomain", Description: "domain sent with EHLO (smtp only), " + defaultEhloDomain + " if empty"},
+		{Field: "mailexpectedbanner", Description: "string the greeting banner must contain"},
+		{Field: "timeoutms", Description: "timeout of the whole conversation, 10000ms if empty"},
+	}
+}
+
+func (checker) Process(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	return ProcessCheck(record)
+}
+
+// replyError is returned when the server answers with an unexpected reply, to tell it apart from network errors
+type replyError struct {
+	command  string
+	expected string
+	reply    string
+}
+
+func (e replyError) Error() string {
+	return fmt.Sprintf("unexpected reply to %s, expected %s, received [%s]", e.command, e.expected, e.reply)
+}
+
+// session keeps the connection and the imap tag counter
+type session struct {
+	text *textproto.Conn
+	tag  int
+}
+
+// protocol groups the commands of the conversation, each function returns a replyError when the server answers badly
+type protocol struct {
+	banner       func(s *session) (string, error)
+	capabilities func(s *session, record dbhelper.CheckRecord) ([]string, error)
+	startTls     func(s *session) error
+	quit         func(s *session)
+	tlsCapable   string
+}
+
+var protocols = map[string]protocol{
+	"SMTP": {banner: smtpBanner, capabilities: smtpCapabilities, startTls: smtpStartTls, quit: smtpQuit, tlsCapable: "STARTTLS"},
+	"IMAP": {banner: imapBanner, capabilities: imapCapabilities, startTls: imapStartTls, quit: imapQuit, tlsCapable: "STARTTLS"},
+	"POP3": {banner: pop3Banner, capabilities: pop3Capabilities, startTls: pop3StartTls, quit: pop3Quit, tlsCapable: "STLS"},
+}
+
+func ProcessCheck(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	var outcome dbhelper.CheckOutcomeRecord
+	var err error
+
+	proto, ok := protocols[record.SubType]
+	if !ok {
+		err = errors.New("subType subtype not correct")
+		return outcome, err
+	}
+
+	return subTypeMail(record, proto)
+}
+
+func subTypeMail(record dbhelper.CheckRecord, proto protocol) (dbhelper.CheckOutcomeRecord, error) {
+	var returnedValue dbhelper.CheckOutcomeRecord
+	var timeout = time.Duration(record.TimeoutMs) * time.Millisecond
+	var address string
+	var conn net.Conn
+	var s session
+	var err error
+
+	if timeout <= 0 {
+		timeout = defaultTimeoutMs * time.Millisecond
+	}
+	if record.Port < 1 || record.Port > 65535 {
+		err = errors.New(fmt.Sprintf("port [%d] not valid", record.Port))
+		returnedValue.ErrorInternal = "Error while preparing mail connection: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = "Error while preparing mail connection"
+		returnedValue.Message = returnedValue.ErrorFriendly
+		return returnedValue, err
+	}
+
+	address = net.JoinHostPort(record.Host, strconv.Itoa(record.Port))
+
+	connectStart := time.Now()
+	conn, err = net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return conversationFailed(returnedValue, "Error while connecting", err), nil
+	}
+	defer conn.Close()
+	returnedValue.ConnectTime = time.Since(connectStart).Microseconds()
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		returnedValue.ResolvedIp = tcpAddr.IP.String()
+	}
+	_ = conn.SetDeadline(connectStart.Add(timeout))
+
+	s.text = textproto.NewConn(conn)
+
+	bannerStart := time.Now()
+	returnedValue.MailBanner, err = proto.banner(&s)
+	returnedValue.MailBannerTime = time.Since(bannerStart).Microseconds()
+	if err != nil {
+		return conversationFailed(returnedValue, "Error while reading the banner", err), nil
+	}
+	if record.MailExpectedBanner != "" && !strings.Contains(returnedValue.MailBanner, record.MailExpectedBanner) {
+		err = errors.New(fmt.Sprintf("banner [%s] does not contain [%s]", returnedValue.MailBanner, record.MailExpectedBanner))
+		returnedValue = conversationFailed(returnedValue, "Unexpected banner", err)
+		returnedValue.FailedAssertion = ASSERTIONBANNER
+		return returnedValue, nil
+	}
+
+	returnedValue.MailCapabilities, err = proto.capabilities(&s, record)
+	if err != nil {
+		return conversationFailed(returnedValue, "Error while reading the capabilities", err), nil
+	}
+
+	if record.MailStartTls {
+		if !hasCapability(returnedValue.MailCapabilities, proto.tlsCapable) {
+			err = errors.New(proto.tlsCapable + " not advertised by the server")
+			returnedValue = conversationFailed(returnedValue, "STARTTLS not supported", err)
+			returnedValue.FailedAssertion = ASSERTIONSTARTTLS
+			return returnedValue, nil
+		}
+		err = proto.startTls(&s)
+		if err != nil {
+			return conversationFailed(returnedValue, "Error while starting tls", err), nil
+		}
+
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: record.Host, RootCAs: rootCAs})
+		handshakeStart := time.Now()
+		err = tlsConn.Handshake()
+		returnedValue.TlsHandshakeTime = time.Since(handshakeStart).Microseconds()
+		if err != nil {
+			returnedValue = conversationFailed(returnedValue, "Error during tls handshake", err)
+			returnedValue.FailedAssertion = ASSERTIONSTARTTLS
+			returnedValue.ErrorCode = errorcode.TLS
+			return returnedValue, nil
+		}
+		returnedValue.MailStartTlsDone = true
+
+		s.text = textproto.NewConn(tlsConn)
+		returnedValue.MailCapabilities, err = proto.capabilities(&s, record)
+		if err != nil {
+			return conversationFailed(returnedValue, "Error while reading the capabilities after STARTTLS", err), nil
+		}
+	}
+
+	proto.quit(&s)
+
+	returnedValue.Message = fmt.Sprintf("Connected to %s (%s), banner [%s]", address, returnedValue.ResolvedIp, returnedValue.MailBanner)
+	if returnedValue.MailStartTlsDone {
+		returnedValue.Message = returnedValue.Message + ", STARTTLS completed"
+	}
+	returnedValue.Success = true
+
+	return returnedValue, nil
+}
+
+// conversationFailed fills the errors of the outcome, like the other checks the errors are exposed to the customers
+func conversationFailed(returnedValue dbhelper.CheckOutcomeRecord, friendly string, err error) dbhelper.CheckOutcomeRecord {
+	var reply replyError
+
+	returnedValue.ErrorInternal = friendly + ": " + err.Error()
+	returnedValue.ErrorOriginal = err.Error()
+	returnedValue.ErrorFriendly = returnedValue.ErrorInternal
+	returnedValue.Message = returnedValue.ErrorFriendly
+	if errors.As(err, &reply) {
+		returnedValue.FailedAssertion = ASSERTIONREPLYCODE
+	} else {
+		returnedValue.ErrorCode = errorcode.Classify(err)
+	}
+
+	return returnedValue
+}
+
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		fields := strings.Fields(c)
+		if len(fields) > 0 && strings.EqualFold(fields[0], capability) {
+			return true
+		}
+	}
+	return false
+}
+
+// smtp, replies are 3 digits codes, possibly on multiple lines
+
+func smtpBanner(s *session) (string, error) {
+	return smtpExpect(s, "banner", 220)
+}
+
+func smtpCapabilities(s *session, record dbhelper.CheckRecord) ([]string, error) {
+	var domain = record.MailEhloDomain
+
+	if domain == "" {
+		domain = defaultEhloDomain
+	}
+	err := s.text.PrintfLine("EHLO %s", domain)
+	if err != nil {
+		return nil, err
+	}
+	message, err := smtpExpect(s, "EHLO", 250)
+	if err != nil {
+		return nil, err
+	}
+
+	// first line is the greeting of the server, the following ones are the extensions
+	lines := strings.Split(message, "\n")
+	return lines[1:], nil
+}
+
+func smtpStartTls(s *session) error {
+	err := s.text.PrintfLine("STARTTLS")
+	if err != nil {
+		return err
+	}
+	_, err = smtpExpect(s, "STARTTLS", 220)
+	return err
+}
+
+func smtpQuit(s *session) {
+	_ = s.text.PrintfLine("QUIT")
+	_, _, _ = s.text.ReadResponse(221)
+}
+
+func smtpExpect(s *session, command string, code int) (string, error) {
+	var protoErr *textproto.Error
+
+	_, message, err := s.text.ReadResponse(code)
+	if errors.As(err, &protoErr) {
+		return message, replyError{command: command, expected: strconv.Itoa(code), reply: fmt.Sprintf("%d %s", protoErr.Code, protoErr.Msg)}
+	}
+	return message, err
+}
+
+// imap, untagged replies start with * and the command is completed by a reply with the same tag of the request
+
+func imapBanner(s *session) (string, error) {
+	line, err := s.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "* OK") && !strings.HasPrefix(line, "* PREAUTH") {
+		return line, replyError{command: "banner", expected: "* OK", reply: line}
+	}
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(line, "* OK"), "* PREAUTH")), nil
+}
+
+func imapCapabilities(s *session, record dbhelper.CheckRecord) ([]string, error) {
+	var capabilities []string
+
+	untagged, err := imapCommand(s, "CAPABILITY")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range untagged {
+		if strings.HasPrefix(strings.ToUpper(line), "* CAPABILITY ") {
+			capabilities = append(capabilities, strings.Fields(line)[2:]...)
+		}
+	}
+
+	return capabilities, nil
+}
+
+func imapStartTls(s *session) error {
+	_, err := imapCommand(s, "STARTTLS")
+	return err
+}
+
+func imapQuit(s *session) {
+	_, _ = imapCommand(s, "LOGOUT")
+}
+
+// imapCommand sends the command and returns the untagged replies received before the tagged OK
+func imapCommand(s *session, command string) ([]string, error) {
+	var untagged []string
+
+	s.tag++
+	tag := fmt.Sprintf("a%d", s.tag)
+	err := s.text.PrintfLine("%s %s", tag, command)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return untagged, err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			if !strings.HasPrefix(strings.ToUpper(line), strings.ToUpper(tag)+" OK") {
+				return untagged, replyError{command: command, expected: "OK", reply: line}
+			}
+			return untagged, nil
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+// pop3, replies start with +OK or -ERR, multi line replies are terminated by a dot
+
+func pop3Banner(s *session) (string, error) {
+	line, err := pop3Expect(s, "banner")
+	return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), err
+}
+
+func pop3Capabilities(s *session, record dbhelper.CheckRecord) ([]string, error) {
+	err := s.text.PrintfLine("CAPA")
+	if err != nil {
+		return nil, err
+	}
+	_, err = pop3Expect(s, "CAPA")
+	if err != nil {
+		return nil, err
+	}
+	return s.text.ReadDotLines()
+}
+
+func pop3StartTls(s *session) error {
+	err := s.text.PrintfLine("STLS")
+	if err != nil {
+		return err
+	}
+	_, err = pop3Expect(s, "STLS")
+	return err
+}
+
+func pop3Quit(s *session) {
+	_ = s.text.PrintfLine("QUIT")
+	_, _ = s.text.ReadLine()
+}
+
+func pop3Expect(s *session, command string) (string, error) {
+	line, err := s.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return line, replyError{command: command, expected: "+OK", reply: line}
+	}
+	return line, nil
+}
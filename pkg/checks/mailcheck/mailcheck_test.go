@@ -0,0 +1,260 @@
+package mailcheck
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"brainyping/pkg/dbhelper"
+)
+
+// fakeServerType answers like a mail server of the protocol, the commands not known are refused
+type fakeServerType struct {
+	protocol  string
+	greeting  string
+	ehloReply string
+	startTls  bool
+	tlsConfig *tls.Config
+}
+
+// startFakeServer serves a single connection, it returns the port to connect to
+func startFakeServer(t *testing.T, server fakeServerType) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		server.serve(conn)
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func (fs fakeServerType) serve(conn net.Conn) {
+	var upgraded bool
+	reader := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			_, _ = fmt.Fprintf(conn, "%s\r\n", l)
+		}
+	}
+
+	reply(fs.greeting)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// imap commands start with the tag
+		tag, command := "", strings.ToUpper(fields[0])
+		if fs.protocol == "IMAP" && len(fields) > 1 {
+			tag, command = fields[0], strings.ToUpper(fields[1])
+		}
+		advertiseTls := fs.startTls && !upgraded
+
+		switch fs.protocol + " " + command {
+		case "SMTP EHLO":
+			if fs.ehloReply != "" {
+				reply(fs.ehloReply)
+				continue
+			}
+			if advertiseTls {
+				reply("250-mail.test greets you", "250-SIZE 1000", "250 STARTTLS")
+				continue
+			}
+			reply("250-mail.test greets you", "250 SIZE 1000")
+		case "IMAP CAPABILITY":
+			if advertiseTls {
+				reply("* CAPABILITY IMAP4rev1 STARTTLS", tag+" OK CAPABILITY completed")
+				continue
+			}
+			reply("* CAPABILITY IMAP4rev1 AUTH=PLAIN", tag+" OK CAPABILITY completed")
+		case "POP3 CAPA":
+			if advertiseTls {
+				reply("+OK capabilities follow", "USER", "STLS", ".")
+				continue
+			}
+			reply("+OK capabilities follow", "USER", "UIDL", ".")
+		case "SMTP STARTTLS", "IMAP STARTTLS", "POP3 STLS":
+			switch fs.protocol {
+			case "SMTP":
+				reply("220 go ahead")
+			case "IMAP":
+				reply(tag + " OK begin TLS negotiation")
+			case "POP3":
+				reply("+OK begin TLS negotiation")
+			}
+			tlsConn := tls.Server(conn, fs.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+			upgraded = true
+		case "SMTP QUIT":
+			reply("221 bye")
+			return
+		case "IMAP LOGOUT":
+			reply("* BYE logging out", tag+" OK LOGOUT completed")
+			return
+		case "POP3 QUIT":
+			reply("+OK bye")
+			return
+		default:
+			switch fs.protocol {
+			case "SMTP":
+				reply("502 command not implemented")
+			case "IMAP":
+				reply(tag + " BAD command unknown")
+			case "POP3":
+				reply("-ERR command unknown")
+			}
+		}
+	}
+}
+
+var greetings = map[string]string{
+	"SMTP": "220 mail.test ESMTP ready",
+	"IMAP": "* OK mail.test IMAP ready",
+	"POP3": "+OK mail.test POP3 ready",
+}
+
+// useTestCertificate returns a tls configuration with a certificate for 127.0.0.1 trusted by the check
+func useTestCertificate(t *testing.T) *tls.Config {
+	certificateServer := httptest.NewTLSServer(nil)
+	certificateServer.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(certificateServer.Certificate())
+	rootCAs = pool
+	t.Cleanup(func() { rootCAs = nil })
+
+	return &tls.Config{Certificates: certificateServer.TLS.Certificates}
+}
+
+func mailRecord(subType string, port int) dbhelper.CheckRecord {
+	return dbhelper.CheckRecord{CheckId: "check1", Type: "MAIL", SubType: subType, Host: "127.0.0.1", Port: port, TimeoutMs: 2000}
+}
+
+func TestBannerAndCapabilities(t *testing.T) {
+	expectedCapability := map[string]string{"SMTP": "SIZE", "IMAP": "AUTH=PLAIN", "POP3": "UIDL"}
+
+	for _, protocol := range []string{"SMTP", "IMAP", "POP3"} {
+		port := startFakeServer(t, fakeServerType{protocol: protocol, greeting: greetings[protocol]})
+		record := mailRecord(protocol, port)
+		record.MailExpectedBanner = "mail.test"
+
+		outcome, err := ProcessCheck(record)
+		if err != nil || !outcome.Success {
+			t.Fatalf("%s: expected success, got %v %+v", protocol, err, outcome)
+		}
+		if !strings.Contains(outcome.MailBanner, "mail.test") {
+			t.Fatalf("%s: banner not recorded, got [%s]", protocol, outcome.MailBanner)
+		}
+		if !hasCapability(outcome.MailCapabilities, expectedCapability[protocol]) {
+			t.Fatalf("%s: expected capability %s, got %v", protocol, expectedCapability[protocol], outcome.MailCapabilities)
+		}
+	}
+}
+
+func TestWrongGreeting(t *testing.T) {
+	wrongGreetings := map[string]string{
+		"SMTP": "554 no service here",
+		"IMAP": "* BYE too many connections",
+		"POP3": "-ERR go away",
+	}
+
+	for protocol, greeting := range wrongGreetings {
+		port := startFakeServer(t, fakeServerType{protocol: protocol, greeting: greeting})
+
+		outcome, err := ProcessCheck(mailRecord(protocol, port))
+		if err != nil || outcome.Success || outcome.FailedAssertion != ASSERTIONREPLYCODE {
+			t.Fatalf("%s: expected reply code failure, got %v %+v", protocol, err, outcome)
+		}
+	}
+}
+
+func TestUnexpectedBanner(t *testing.T) {
+	port := startFakeServer(t, fakeServerType{protocol: "SMTP", greeting: greetings["SMTP"]})
+	record := mailRecord("SMTP", port)
+	record.MailExpectedBanner = "mail.example.com"
+
+	outcome, err := ProcessCheck(record)
+	if err != nil || outcome.Success || outcome.FailedAssertion != ASSERTIONBANNER {
+		t.Fatalf("expected banner failure, got %v %+v", err, outcome)
+	}
+}
+
+func TestEhloRefused(t *testing.T) {
+	port := startFakeServer(t, fakeServerType{protocol: "SMTP", greeting: greetings["SMTP"], ehloReply: "502 EHLO not implemented"})
+
+	outcome, err := ProcessCheck(mailRecord("SMTP", port))
+	if err != nil || outcome.Success || outcome.FailedAssertion != ASSERTIONREPLYCODE {
+		t.Fatalf("expected reply code failure, got %v %+v", err, outcome)
+	}
+	if !strings.Contains(outcome.ErrorOriginal, "502") {
+		t.Fatalf("expected the reply received in the error, got %s", outcome.ErrorOriginal)
+	}
+}
+
+func TestStartTlsAdvertised(t *testing.T) {
+	tlsConfig := useTestCertificate(t)
+
+	for _, protocol := range []string{"SMTP", "IMAP", "POP3"} {
+		port := startFakeServer(t, fakeServerType{protocol: protocol, greeting: greetings[protocol], startTls: true, tlsConfig: tlsConfig})
+		record := mailRecord(protocol, port)
+		record.MailStartTls = true
+
+		outcome, err := ProcessCheck(record)
+		if err != nil || !outcome.Success || !outcome.MailStartTlsDone {
+			t.Fatalf("%s: expected STARTTLS completed, got %v %+v", protocol, err, outcome)
+		}
+		// the capabilities are the ones read over tls, the upgrade is not advertised anymore
+		if hasCapability(outcome.MailCapabilities, protocols[protocol].tlsCapable) {
+			t.Fatalf("%s: expected the capabilities read after STARTTLS, got %v", protocol, outcome.MailCapabilities)
+		}
+	}
+}
+
+func TestStartTlsNotAdvertised(t *testing.T) {
+	for _, protocol := range []string{"SMTP", "IMAP", "POP3"} {
+		port := startFakeServer(t, fakeServerType{protocol: protocol, greeting: greetings[protocol]})
+		record := mailRecord(protocol, port)
+		record.MailStartTls = true
+
+		outcome, err := ProcessCheck(record)
+		if err != nil || outcome.Success || outcome.FailedAssertion != ASSERTIONSTARTTLS || outcome.MailStartTlsDone {
+			t.Fatalf("%s: expected STARTTLS failure, got %v %+v", protocol, err, outcome)
+		}
+	}
+}
+
+func TestStartTlsWithCertificateNotTrusted(t *testing.T) {
+	tlsConfig := useTestCertificate(t)
+	rootCAs = x509.NewCertPool()
+
+	port := startFakeServer(t, fakeServerType{protocol: "SMTP", greeting: greetings["SMTP"], startTls: true, tlsConfig: tlsConfig})
+	record := mailRecord("SMTP", port)
+	record.MailStartTls = true
+
+	outcome, err := ProcessCheck(record)
+	if err != nil || outcome.Success || outcome.FailedAssertion != ASSERTIONSTARTTLS || outcome.MailStartTlsDone {
+		t.Fatalf("expected tls handshake failure, got %v %+v", err, outcome)
+	}
+}
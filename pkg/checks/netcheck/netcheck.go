@@ -1,16 +1,125 @@
 package netcheck
 
 import (
-	"brainyping/pkg/queuehelper"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/checks/registry"
+	"brainyping/pkg/dbhelper"
 )
 
-func ProcessRequest(check *queuehelper.CheckRecordQueued) {
-	switch check.Record.SubType {
-	case "NET":
+type checker struct{}
+
+func init() {
+	registry.Register(checker{})
+}
+
+func (checker) Type() string {
+	return "NET"
+}
+
+func (checker) SubTypes() []string {
+	return []string{"TCP", "TLS"}
+}
+
+func (checker) Description() string {
+	return "TCP connection to host and port, TLS also performs the handshake"
+}
+
+func (checker) ConfigSchema() []registry.ConfigField {
+	return []registry.ConfigField{
+		{Field: "host", Description: "host name or ip address", Required: true},
+		{Field: "port", Description: "tcp port", Required: true},
+	}
+}
+
+func (checker) Process(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	return ProcessCheck(record.Host, record.Port, record.SubType)
+}
+
+func ProcessCheck(host string, port int, subType string) (dbhelper.CheckOutcomeRecord, error) {
+	var outcome dbhelper.CheckOutcomeRecord
+	var err error
+
+	switch subType {
+	case "TCP":
+		outcome, err = subTypeTcp(host, port, false)
+		break
+	case "TLS":
+		outcome, err = subTypeTcp(host, port, true)
 		break
 	default:
+		err = errors.New("subType subtype not correct")
+	}
+
+	return outcome, err
+}
+
+func subTypeTcp(host string, port int, withTls bool) (dbhelper.CheckOutcomeRecord, error) {
+	var err error
+	var conn net.Conn
+	var tlsConn *tls.Conn
+	var dialer net.Dialer
+	var timeout = 10000 * time.Millisecond
+	var returnedValue dbhelper.CheckOutcomeRecord
+	var address string
+	var connectStart time.Time
+	var handshakeStart time.Time
+
+	if port < 1 || port > 65535 {
+		err = errors.New(fmt.Sprintf("port [%d] not valid", port))
+		returnedValue.ErrorInternal = "Error while preparing tcp connection: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = "Error while preparing TCP connection"
+		returnedValue.Message = returnedValue.ErrorFriendly
+		return returnedValue, err
+	}
+
+	address = net.JoinHostPort(host, strconv.Itoa(port))
+	dialer = net.Dialer{Timeout: timeout}
+
+	connectStart = time.Now()
+	conn, err = dialer.Dial("tcp", address)
+	if err != nil {
+		returnedValue.ErrorInternal = "Error while connecting: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = returnedValue.ErrorInternal
+		returnedValue.Message = returnedValue.ErrorFriendly
+		returnedValue.ErrorCode = errorcode.Classify(err)
+		// like the http checks, connection errors are exposed to the customers so returned error is nil
+		return returnedValue, nil
+	}
+	defer conn.Close()
+	returnedValue.ConnectTime = time.Since(connectStart).Microseconds()
 
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		returnedValue.ResolvedIp = tcpAddr.IP.String()
 	}
-	return
 
+	if withTls {
+		tlsConn = tls.Client(conn, &tls.Config{ServerName: host})
+		_ = tlsConn.SetDeadline(time.Now().Add(timeout))
+		handshakeStart = time.Now()
+		err = tlsConn.Handshake()
+		returnedValue.TlsHandshakeTime = time.Since(handshakeStart).Microseconds()
+		if err != nil {
+			returnedValue.ErrorInternal = "Error during tls handshake: " + err.Error()
+			returnedValue.ErrorOriginal = err.Error()
+			returnedValue.ErrorFriendly = returnedValue.ErrorInternal
+			returnedValue.Message = returnedValue.ErrorFriendly
+			returnedValue.ErrorCode = errorcode.TLS
+			return returnedValue, nil
+		}
+		defer tlsConn.Close()
+	}
+
+	returnedValue.Message = fmt.Sprintf("Connected to %s (%s)", address, returnedValue.ResolvedIp)
+	returnedValue.Success = true
+
+	return returnedValue, nil
 }
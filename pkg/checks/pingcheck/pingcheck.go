@@ -0,0 +1,256 @@
+package pingcheck
+
+// ICMP requires raw sockets (and privileges we don't have in the worker containers) so the "ping" is performed with tcp or udp probes.
+// A tcp probe is successful when the connection is established, a udp probe is successful when any datagram is received back
+// (so the target needs to run a udp service replying to our probe, an echo service for example).
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/checks/registry"
+	"brainyping/pkg/dbhelper"
+)
+
+const ASSERTIONLOSS = "PINGLOSS"
+const ASSERTIONLATENCY = "PINGLATENCY"
+
+const defaultCount = 5
+const defaultIntervalMs = 200
+const defaultProbeTimeoutMs = 2000
+
+// a check holds a worker goroutine for all its probes, values outside these limits are a configuration error
+const maxCount = 100
+const maxIntervalMs = 10000
+const maxProbeTimeoutMs = 30000
+const maxDurationMs = 120000
+
+type checker struct{}
+
+func init() {
+	registry.Register(checker{})
+}
+
+func (checker) Type() string {
+	return "PING"
+}
+
+func (checker) SubTypes() []string {
+	return []string{"TCP", "UDP"}
+}
+
+func (checker) Description() string {
+	return "Sends a number of tcp connect or udp probes and reports latency, jitter and packet loss"
+}
+
+func (checker) ConfigSchema() []registry.ConfigField {
+	return []registry.ConfigField{
+		{Field: "host", Description: "host name or ip address", Required: true},
+		{Field: "port", Description: "tcp or udp port", Required: true},
+		{Field: "pingcount", Description: "number of probes (max 100), 5 if empty"},
+		{Field: "pingintervalms", Description: "pause between probes (max 10000ms), 200ms if empty"},
+		{Field: "timeoutms", Description: "timeout of each probe (max 30000ms), 2000ms if empty"},
+		{Field: "pingmaxlossperc", Description: "max percentage of probes lost before failing (0-100), if empty any probe lost fails the check"},
+		{Field: "pingmaxlatencyms", Description: "max average latency before failing, not verified if empty"},
+	}
+}
+
+func (checker) Process(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	return ProcessCheck(record)
+}
+
+func ProcessCheck(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	var outcome dbhelper.CheckOutcomeRecord
+	var err error
+
+	switch record.SubType {
+	case "TCP":
+		outcome, err = subTypePing(record, probeTcp)
+		break
+	case "UDP":
+		outcome, err = subTypePing(record, probeUdp)
+		break
+	default:
+		err = errors.New("subType subtype not correct")
+	}
+
+	return outcome, err
+}
+
+func subTypePing(record dbhelper.CheckRecord, probe func(address string, timeout time.Duration) (time.Duration, error)) (dbhelper.CheckOutcomeRecord, error) {
+	var returnedValue dbhelper.CheckOutcomeRecord
+	var address string
+	var rtts []time.Duration
+	var lastErr error
+
+	count, interval, timeout, err := probesSettings(record)
+	if err == nil && (record.Port < 1 || record.Port > 65535) {
+		err = errors.New(fmt.Sprintf("port [%d] not valid", record.Port))
+	}
+	if err != nil {
+		returnedValue.ErrorInternal = "Error while preparing probes: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = "Error while preparing probes"
+		returnedValue.Message = returnedValue.ErrorFriendly
+		return returnedValue, err
+	}
+
+	address = net.JoinHostPort(record.Host, strconv.Itoa(record.Port))
+
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		rtt, err := probe(address, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rtts = append(rtts, rtt)
+	}
+
+	returnedValue.PingSent = count
+	returnedValue.PingReceived = len(rtts)
+	returnedValue.PingLossPerc = float64(count-len(rtts)) / float64(count) * 100
+	returnedValue.PingMinTime, returnedValue.PingAvgTime, returnedValue.PingMaxTime, returnedValue.PingJitter = rttStatistics(rtts)
+
+	returnedValue.Message = fmt.Sprintf("%d probes sent, %d received, %.1f%% loss, min/avg/max/jitter %.3f/%.3f/%.3f/%.3f ms",
+		returnedValue.PingSent,
+		returnedValue.PingReceived,
+		returnedValue.PingLossPerc,
+		float64(returnedValue.PingMinTime)/1000,
+		float64(returnedValue.PingAvgTime)/1000,
+		float64(returnedValue.PingMaxTime)/1000,
+		float64(returnedValue.PingJitter)/1000)
+
+	if len(rtts) == 0 || returnedValue.PingLossPerc > float64(record.PingMaxLossPerc) {
+		returnedValue.ErrorOriginal = fmt.Sprintf("Packet loss %.1f%% above the threshold of %d%%", returnedValue.PingLossPerc, record.PingMaxLossPerc)
+		if lastErr != nil {
+			returnedValue.ErrorOriginal = returnedValue.ErrorOriginal + ", last error: " + lastErr.Error()
+		}
+		if len(rtts) == 0 {
+			// nothing came back, the cause is more interesting than the loss percentage
+			returnedValue.ErrorCode = errorcode.Classify(lastErr)
+		}
+		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+		returnedValue.FailedAssertion = ASSERTIONLOSS
+		return returnedValue, nil
+	}
+
+	if record.PingMaxLatencyMs > 0 && returnedValue.PingAvgTime > int64(record.PingMaxLatencyMs)*1000 {
+		returnedValue.ErrorOriginal = fmt.Sprintf("Average latency %.3fms above the threshold of %dms", float64(returnedValue.PingAvgTime)/1000, record.PingMaxLatencyMs)
+		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+		returnedValue.FailedAssertion = ASSERTIONLATENCY
+		return returnedValue, nil
+	}
+
+	returnedValue.Success = true
+
+	return returnedValue, nil
+}
+
+func probeTcp(address string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	_ = conn.Close()
+	return rtt, nil
+}
+
+func probeUdp(address string, timeout time.Duration) (time.Duration, error) {
+	var buffer = make([]byte, 512)
+
+	conn, err := net.DialTimeout("udp", address, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	start := time.Now()
+	_, err = conn.Write([]byte("brainyping"))
+	if err != nil {
+		return 0, err
+	}
+	_, err = conn.Read(buffer)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// probesSettings returns the number of probes, the pause between them and their timeout, with the defaults for the empty ones
+func probesSettings(record dbhelper.CheckRecord) (int, time.Duration, time.Duration, error) {
+	var count = record.PingCount
+	var intervalMs = record.PingIntervalMs
+	var timeoutMs = record.TimeoutMs
+
+	if count < 0 || count > maxCount {
+		return 0, 0, 0, errors.New(fmt.Sprintf("probes count [%d] not valid, it needs to be between 1 and %d", count, maxCount))
+	}
+	if intervalMs < 0 || intervalMs > maxIntervalMs {
+		return 0, 0, 0, errors.New(fmt.Sprintf("probes interval [%dms] not valid, it needs to be between 1 and %dms", intervalMs, maxIntervalMs))
+	}
+	if timeoutMs < 0 || timeoutMs > maxProbeTimeoutMs {
+		return 0, 0, 0, errors.New(fmt.Sprintf("probe timeout [%dms] not valid, it needs to be between 1 and %dms", timeoutMs, maxProbeTimeoutMs))
+	}
+	if record.PingMaxLossPerc < 0 || record.PingMaxLossPerc > 100 {
+		return 0, 0, 0, errors.New(fmt.Sprintf("max loss [%d%%] not valid, it needs to be between 0 and 100", record.PingMaxLossPerc))
+	}
+
+	if count == 0 {
+		count = defaultCount
+	}
+	if intervalMs == 0 {
+		intervalMs = defaultIntervalMs
+	}
+	if timeoutMs == 0 {
+		timeoutMs = defaultProbeTimeoutMs
+	}
+	if durationMs := count*timeoutMs + (count-1)*intervalMs; durationMs > maxDurationMs {
+		return 0, 0, 0, errors.New(fmt.Sprintf("probes could take up to %dms, more than the max of %dms, reduce count, interval or timeout", durationMs, maxDurationMs))
+	}
+
+	return count, time.Duration(intervalMs) * time.Millisecond, time.Duration(timeoutMs) * time.Millisecond, nil
+}
+
+// rttStatistics returns min, avg, max and jitter in microseconds, jitter is the average difference between consecutive probes
+func rttStatistics(rtts []time.Duration) (int64, int64, int64, int64) {
+	var min, max, sum, jitterSum time.Duration
+
+	if len(rtts) == 0 {
+		return 0, 0, 0, 0
+	}
+
+	min = rtts[0]
+	for i, rtt := range rtts {
+		if rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		sum += rtt
+		if i > 0 {
+			jitterSum += time.Duration(math.Abs(float64(rtt - rtts[i-1])))
+		}
+	}
+
+	avg := sum / time.Duration(len(rtts))
+	var jitter time.Duration
+	if len(rtts) > 1 {
+		jitter = jitterSum / time.Duration(len(rtts)-1)
+	}
+
+	return min.Microseconds(), avg.Microseconds(), max.Microseconds(), jitter.Microseconds()
+}
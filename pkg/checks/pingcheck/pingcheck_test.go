@@ -0,0 +1,66 @@
+package pingcheck
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"brainyping/pkg/dbhelper"
+)
+
+func TestProbesSettingsDefaults(t *testing.T) {
+	count, interval, timeout, err := probesSettings(dbhelper.CheckRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != defaultCount || interval != defaultIntervalMs*time.Millisecond || timeout != defaultProbeTimeoutMs*time.Millisecond {
+		t.Fatalf("unexpected defaults %d %s %s", count, interval, timeout)
+	}
+}
+
+func TestProbesSettingsOutOfRange(t *testing.T) {
+	records := []dbhelper.CheckRecord{
+		{PingCount: -1},
+		{PingCount: maxCount + 1},
+		{PingIntervalMs: -200},
+		{PingIntervalMs: maxIntervalMs + 1},
+		{TimeoutMs: -1},
+		{TimeoutMs: maxProbeTimeoutMs + 1},
+		{PingMaxLossPerc: 101},
+		{PingCount: maxCount, TimeoutMs: maxProbeTimeoutMs},
+	}
+
+	for _, record := range records {
+		outcome, err := subTypePing(record, func(address string, timeout time.Duration) (time.Duration, error) {
+			t.Fatal("probe sent with a configuration not valid")
+			return 0, nil
+		})
+		if err == nil || outcome.Success || outcome.ErrorInternal == "" {
+			t.Fatalf("expected a configuration error for %+v, got %v %+v", record, err, outcome)
+		}
+	}
+}
+
+func TestLossThreshold(t *testing.T) {
+	var sent int
+	// every other probe is lost
+	probe := func(address string, timeout time.Duration) (time.Duration, error) {
+		sent++
+		if sent%2 == 0 {
+			return 0, errors.New("i/o timeout")
+		}
+		return time.Millisecond, nil
+	}
+	record := dbhelper.CheckRecord{Host: "127.0.0.1", Port: 7, PingCount: 4, PingIntervalMs: 1}
+
+	outcome, err := subTypePing(record, probe)
+	if err != nil || outcome.Success || outcome.PingLossPerc != 50 {
+		t.Fatalf("expected a failure with the default max loss, got %v %+v", err, outcome)
+	}
+
+	record.PingMaxLossPerc = 50
+	outcome, err = subTypePing(record, probe)
+	if err != nil || !outcome.Success {
+		t.Fatalf("expected a success within the max loss, got %v %+v", err, outcome)
+	}
+}
@@ -0,0 +1,105 @@
+package registry
+
+// The registry keeps the list of check types supported by the application.
+// Each check package registers its own Checker in an init() function, the same way migrations register themselves in the migration engine.
+// Importing the package `brainyping/pkg/checks` is enough to have all the check types registered.
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"brainyping/pkg/dbhelper"
+)
+
+// Checker is the interface each check type needs to implement to be registered
+type Checker interface {
+	// Type returns the value stored in CheckRecord.Type for this check type
+	Type() string
+	// SubTypes returns the values allowed in CheckRecord.SubType for this check type
+	SubTypes() []string
+	Description() string
+	// ConfigSchema returns the list of CheckRecord fields used by the check type
+	ConfigSchema() []ConfigField
+	Process(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error)
+}
+
+// ConfigField describes a CheckRecord field used by a check type, Field is the bson name of the field
+type ConfigField struct {
+	Field       string
+	Description string
+	Required    bool
+}
+
+var checkers = map[string]Checker{}
+var checkersMutex sync.RWMutex
+
+// Register adds a check type to the registry, registering the same type twice is a programming error, so we panic
+func Register(checker Checker) {
+	checkersMutex.Lock()
+	defer checkersMutex.Unlock()
+	if _, exists := checkers[checker.Type()]; exists {
+		panic(fmt.Sprintf("check type [%s] already registered", checker.Type()))
+	}
+	checkers[checker.Type()] = checker
+}
+
+func Get(checkType string) (Checker, bool) {
+	checkersMutex.RLock()
+	defer checkersMutex.RUnlock()
+	checker, exists := checkers[checkType]
+	return checker, exists
+}
+
+// List returns the registered check types ordered by type
+func List() []Checker {
+	var list []Checker
+	checkersMutex.RLock()
+	defer checkersMutex.RUnlock()
+	for _, c := range checkers {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Type() < list[j].Type() })
+	return list
+}
+
+// Validate makes sure the check type and subtype are supported and the required fields of the check type are populated
+func Validate(record dbhelper.CheckRecord) error {
+	checker, exists := Get(record.Type)
+	if !exists {
+		return errors.New(fmt.Sprintf("check type [%s] not supported", record.Type))
+	}
+	if !subTypeSupported(checker, record.SubType) {
+		return errors.New(fmt.Sprintf("subtype [%s] not supported by check type [%s], supported subtypes are %s", record.SubType, record.Type, strings.Join(checker.SubTypes(), ",")))
+	}
+	for _, f := range checker.ConfigSchema() {
+		if f.Required && fieldIsEmpty(record, f.Field) {
+			return errors.New(fmt.Sprintf("field [%s] is required by check type [%s]", f.Field, record.Type))
+		}
+	}
+	return nil
+}
+
+func subTypeSupported(checker Checker, subType string) bool {
+	for _, st := range checker.SubTypes() {
+		if st == subType {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldIsEmpty looks for the field in the check record using its bson name, fields not found are considered empty
+func fieldIsEmpty(record dbhelper.CheckRecord, bsonName string) bool {
+	v := reflect.ValueOf(record)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if strings.Split(t.Field(i).Tag.Get("bson"), ",")[0] == bsonName {
+			return v.Field(i).IsZero()
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+package tlscheck
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"brainyping/pkg/checks/errorcode"
+	"brainyping/pkg/checks/registry"
+	"brainyping/pkg/dbhelper"
+)
+
+var TlsCheckDefaultWarningDays int
+
+const ASSERTIONCHAIN = "TLSCHAIN"
+const ASSERTIONHOSTNAME = "TLSHOSTNAME"
+const ASSERTIONEXPIRY = "TLSEXPIRY"
+
+type checker struct{}
+
+func init() {
+	registry.Register(checker{})
+}
+
+func (checker) Type() string {
+	return "TLS"
+}
+
+func (checker) SubTypes() []string {
+	return []string{"CERT"}
+}
+
+func (checker) Description() string {
+	return "TLS certificate chain, hostname and expiration validation"
+}
+
+func (checker) ConfigSchema() []registry.ConfigField {
+	return []registry.ConfigField{
+		{Field: "host", Description: "host name, used also to verify the certificate", Required: true},
+		{Field: "port", Description: "tcp port, 443 if empty"},
+		{Field: "tlsexpirywarningdays", Description: "days before expiration when the check starts failing, worker default used if empty"},
+	}
+}
+
+func (checker) Process(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	return ProcessCheck(record)
+}
+
+func ProcessCheck(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	var outcome dbhelper.CheckOutcomeRecord
+	var err error
+
+	switch record.SubType {
+	case "CERT":
+		outcome, err = subTypeCert(record)
+		break
+	default:
+		err = errors.New("subType subtype not correct")
+	}
+
+	return outcome, err
+}
+
+// subTypeCert connects to the host, retrieves the certificates chain presented and validates it
+// the certificate is verified manually after the handshake so that we can still report its details when it is not valid
+func subTypeCert(record dbhelper.CheckRecord) (dbhelper.CheckOutcomeRecord, error) {
+	var err error
+	var conn *tls.Conn
+	var dialer net.Dialer
+	var timeout = 10000 * time.Millisecond
+	var returnedValue dbhelper.CheckOutcomeRecord
+	var port = record.Port
+	var warningDays = record.TlsExpiryWarningDays
+	var address string
+	var leaf *x509.Certificate
+	var intermediates *x509.CertPool
+	var connectStart time.Time
+
+	if port == 0 {
+		port = 443
+	}
+	if warningDays == 0 {
+		warningDays = TlsCheckDefaultWarningDays
+	}
+
+	address = net.JoinHostPort(record.Host, strconv.Itoa(port))
+	dialer = net.Dialer{Timeout: timeout}
+
+	connectStart = time.Now()
+	conn, err = tls.DialWithDialer(&dialer, "tcp", address, &tls.Config{ServerName: record.Host, InsecureSkipVerify: true})
+	if err != nil {
+		returnedValue.ErrorInternal = "Error while connecting: " + err.Error()
+		returnedValue.ErrorOriginal = err.Error()
+		returnedValue.ErrorFriendly = returnedValue.ErrorInternal
+		returnedValue.Message = returnedValue.ErrorFriendly
+		returnedValue.ErrorCode = errorcode.Classify(err)
+		return returnedValue, nil
+	}
+	defer conn.Close()
+	returnedValue.TlsHandshakeTime = time.Since(connectStart).Microseconds()
+
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		returnedValue.ResolvedIp = tcpAddr.IP.String()
+	}
+
+	peerCertificates := conn.ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		returnedValue.ErrorOriginal = "No certificate presented by the server"
+		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+		returnedValue.FailedAssertion = ASSERTIONCHAIN
+		returnedValue.ErrorCode = errorcode.TLS
+		return returnedValue, nil
+	}
+
+	leaf = peerCertificates[0]
+	intermediates = x509.NewCertPool()
+	for _, c := range peerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+
+	returnedValue.TlsIssuer = leaf.Issuer.String()
+	returnedValue.TlsSans = leaf.DNSNames
+	returnedValue.TlsNotAfterUnix = leaf.NotAfter.Unix()
+	returnedValue.TlsDaysToExpiry = int(time.Until(leaf.NotAfter).Hours() / 24)
+
+	_, err = leaf.Verify(x509.VerifyOptions{Intermediates: intermediates})
+	returnedValue.TlsChainValid = err == nil
+	if err != nil {
+		returnedValue.ErrorOriginal = err.Error()
+	}
+
+	returnedValue.TlsHostnameMatch = leaf.VerifyHostname(record.Host) == nil
+
+	returnedValue.Message = fmt.Sprintf("Certificate issued by %s expires in %d days (%s)", returnedValue.TlsIssuer, returnedValue.TlsDaysToExpiry, strings.Join(leaf.DNSNames, ","))
+
+	if !returnedValue.TlsChainValid {
+		returnedValue.ErrorInternal = "Certificate chain not valid: " + returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorInternal
+		returnedValue.FailedAssertion = ASSERTIONCHAIN
+		returnedValue.ErrorCode = errorcode.TLS
+		return returnedValue, nil
+	}
+
+	if !returnedValue.TlsHostnameMatch {
+		returnedValue.ErrorOriginal = fmt.Sprintf("Certificate not valid for host %s", record.Host)
+		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+		returnedValue.FailedAssertion = ASSERTIONHOSTNAME
+		returnedValue.ErrorCode = errorcode.TLS
+		return returnedValue, nil
+	}
+
+	if returnedValue.TlsDaysToExpiry < warningDays {
+		returnedValue.ErrorOriginal = fmt.Sprintf("Certificate expires in %d days, warning window is %d days", returnedValue.TlsDaysToExpiry, warningDays)
+		returnedValue.ErrorInternal = returnedValue.ErrorOriginal
+		returnedValue.ErrorFriendly = returnedValue.ErrorOriginal
+		returnedValue.FailedAssertion = ASSERTIONEXPIRY
+		return returnedValue, nil
+	}
+
+	returnedValue.Success = true
+
+	return returnedValue, nil
+}
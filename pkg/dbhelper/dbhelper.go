@@ -16,25 +16,52 @@ var client *mongo.Client
 var Initialised bool
 
 type CheckRecord struct {
-	CheckId            string     `bson:"checkid"`
-	Name               string     `bson:"name"`
-	NameFriendly       string     `bson:"namefriendly"`
-	Host               string     `bson:"host"`
-	Port               int        `bson:"port"`
-	Type               string     `bson:"type"`
-	SubType            string     `bson:"subtype"`
-	Frequency          int        `bson:"frequency"`
-	UserAgent          string     `bson:"useragent"`
-	HttpHeaders        [][]string `bson:"httpheaders"`
-	HttpBody           string     `bson:"httpbody"`
-	HttpStatusCodeOK   int        `bson:"httpstatuscodeok"`
-	ResponseString     string     `bson:"responsestring"`
-	Regions            [][]string `bson:"regions"`
-	Enabled            bool       `bson:"enabled"`
-	CreatedUnix        int64      `bson:"createdunix"`
-	UpdatedUnix        int64      `bson:"updatedunix"`
-	StartSchedTimeUnix int64      `bson:"startschedtimeunix"`
-	OwnerUid           string     `bson:"owneruid"`
+	CheckId                 string          `bson:"checkid"`
+	Name                    string          `bson:"name"`
+	NameFriendly            string          `bson:"namefriendly"`
+	Host                    string          `bson:"host"`
+	Port                    int             `bson:"port"`
+	Type                    string          `bson:"type"`
+	SubType                 string          `bson:"subtype"`
+	Frequency               int             `bson:"frequency"`
+	FrequencyUnit           string          `bson:"frequencyunit"`
+	CronExpression          string          `bson:"cronexpression"`
+	CronTimezone            string          `bson:"crontimezone"`
+	UserAgent               string          `bson:"useragent"`
+	HttpHeaders             [][]string      `bson:"httpheaders"`
+	HttpBody                string          `bson:"httpbody"`
+	HttpStatusCodeOK        int             `bson:"httpstatuscodeok"`
+	ResponseString          string          `bson:"responsestring"`
+	ResponseStringIsRegex   bool            `bson:"responsestringisregex"`
+	HttpAssertions          []HttpAssertion `bson:"httpassertions"`
+	HttpSteps               []HttpStep      `bson:"httpsteps"`
+	TimeoutMs               int             `bson:"timeoutms"`
+	SlowThresholdMs         int             `bson:"slowthresholdms"`
+	HttpDontFollowRedirects bool            `bson:"httpdontfollowredirects"`
+	HttpMaxRedirects        int             `bson:"httpmaxredirects"`
+	HttpFailOnHostChange    bool            `bson:"httpfailonhostchange"`
+	HttpFailOnDowngrade     bool            `bson:"httpfailondowngrade"`
+	TlsExpiryWarningDays    int             `bson:"tlsexpirywarningdays"`
+	PingCount               int             `bson:"pingcount"`
+	PingIntervalMs          int             `bson:"pingintervalms"`
+	PingMaxLossPerc         int             `bson:"pingmaxlossperc"`
+	PingMaxLatencyMs        int             `bson:"pingmaxlatencyms"`
+	DnsResolver             string          `bson:"dnsresolver"`
+	DnsExpectedAnswers      []string        `bson:"dnsexpectedanswers"`
+	MailStartTls            bool            `bson:"mailstarttls"`
+	MailEhloDomain          string          `bson:"mailehlodomain"`
+	MailExpectedBanner      string          `bson:"mailexpectedbanner"`
+	ConfirmRegions          int             `bson:"confirmregions"`
+	ConfirmQuorum           int             `bson:"confirmquorum"`
+	Regions                 [][]string      `bson:"regions"`
+	RegionsStrategy         string          `bson:"regionsstrategy"`
+	RegionsEachTime         int             `bson:"regionseachtime"`
+	Enabled                 bool            `bson:"enabled"`
+	CreatedUnix             int64           `bson:"createdunix"`
+	UpdatedUnix             int64           `bson:"updatedunix"`
+	StartSchedTimeUnix      int64           `bson:"startschedtimeunix"`
+	OwnerUid                string          `bson:"owneruid"`
+	RobotsTxtHash           string          `bson:"robotstxthash"` // last robots.txt hash seen, kept by the response collector
 }
 
 type CheckResponseRecordDb struct {
@@ -44,6 +71,7 @@ type CheckResponseRecordDb struct {
 	SubRegion              string            `bson:"subregion"`
 	ScheduledTimeUnix      int64             `bson:"scheduledtimeunix"`
 	ScheduledTimeDelay     int64             `bson:"scheduledtimedelay"`
+	SchedulerDelay         int64             `bson:"schedulerdelay"`
 	QueuedRequestUnix      int64             `bson:"queuedrequestunix"`
 	ReceivedByWorkerUnix   int64             `bson:"receivedbyworkerunix"`
 	ProcessedUnix          int64             `bson:"processedunix"`
@@ -58,28 +86,156 @@ type CheckResponseRecordDb struct {
 	ErrorInternal          string            `bson:"errorinternal"`
 	ErrorFatal             string            `bson:"errorfatal"`
 	Message                string            `bson:"message"`
+	ErrorCode              string            `bson:"errorcode"`
 	Redirects              int               `bson:"redirects"`
 	RedirectsHistory       []RedirectHistory `bson:"redirectshistory"`
 	RequestId              string            `bson:"requestid"`
+	ConfirmationOf         string            `bson:"confirmationof"`
+	RunId                  string            `bson:"runid"`
+	RunRegions             int               `bson:"runregions"`
+	ConfirmationsRequested int               `bson:"confirmationsrequested"`
+	ConfirmQuorum          int               `bson:"confirmquorum"`
 	WorkerHostname         string            `bson:"workerhostname"`
 	WorkerHostnameFriendly string            `bson:"workerhostnamefriendly"`
 	Attempts               int               `bson:"attempts"`
+	InFlightRequeues       int               `bson:"inflightrequeues"`
 	ContentLength          int64             `bson:"contentlength"`
+	ResolvedIp             string            `bson:"resolvedip"`
+	ConnectTime            int64             `bson:"connecttime"`
+	TlsHandshakeTime       int64             `bson:"tlshandshaketime"`
+	TtfbTime               int64             `bson:"ttfbtime"`
+	TransferTime           int64             `bson:"transfertime"`
+	FailedAssertion        string            `bson:"failedassertion"`
+	RobotsTxtExists        bool              `bson:"robotstxtexists"`
+	RobotsTxtBlocksAll     bool              `bson:"robotstxtblocksall"`
+	RobotsTxtChanged       bool              `bson:"robotstxtchanged"`
+	RobotsTxtHash          string            `bson:"robotstxthash"`
+	TlsDaysToExpiry        int               `bson:"tlsdaystoexpiry"`
+	TlsNotAfterUnix        int64             `bson:"tlsnotafterunix"`
+	TlsIssuer              string            `bson:"tlsissuer"`
+	TlsSans                []string          `bson:"tlssans"`
+	TlsHostnameMatch       bool              `bson:"tlshostnamematch"`
+	TlsChainValid          bool              `bson:"tlschainvalid"`
+	DnsTime                int64             `bson:"dnstime"`
+	DnsAnswers             []string          `bson:"dnsanswers"`
+	Degraded               bool              `bson:"degraded"`
+	BodyTruncated          bool              `bson:"bodytruncated"`
+	AssertionsResults      []AssertionResult `bson:"assertionsresults"`
+	StepsResults           []HttpStepResult  `bson:"stepsresults"`
+	FailedStep             int               `bson:"failedstep"`
+	PingSent               int               `bson:"pingsent"`
+	PingReceived           int               `bson:"pingreceived"`
+	PingLossPerc           float64           `bson:"pinglossperc"`
+	PingMinTime            int64             `bson:"pingmintime"`
+	PingAvgTime            int64             `bson:"pingavgtime"`
+	PingMaxTime            int64             `bson:"pingmaxtime"`
+	PingJitter             int64             `bson:"pingjitter"`
+	MailBanner             string            `bson:"mailbanner"`
+	MailCapabilities       []string          `bson:"mailcapabilities"`
+	MailBannerTime         int64             `bson:"mailbannertime"`
+	MailStartTlsDone       bool              `bson:"mailstarttlsdone"`
 }
 
 type CheckOutcomeRecord struct {
-	TimeSpent        int64             `bson:"timespent"`
-	Success          bool              `bson:"success"`
-	ErrorOriginal    string            `bson:"errororiginal"`
-	ErrorFriendly    string            `bson:"errorfriendly "`
-	ErrorInternal    string            `bson:"errorinternal"`
-	Message          string            `bson:"message"`
-	Redirects        int               `bson:"redirects"`
-	RedirectsHistory []RedirectHistory `bson:"redirectshistory"`
-	CreatedUnix      int64             `bson:"createdunix"`
-	Region           string            `bson:"region"`
-	SubRegion        string            `bson:"subregion"`
-	ContentLength    int64             `bson:"contentlength"`
+	TimeSpent          int64             `bson:"timespent"`
+	Success            bool              `bson:"success"`
+	ErrorOriginal      string            `bson:"errororiginal"`
+	ErrorFriendly      string            `bson:"errorfriendly "`
+	ErrorInternal      string            `bson:"errorinternal"`
+	Message            string            `bson:"message"`
+	ErrorCode          string            `bson:"errorcode"`
+	Redirects          int               `bson:"redirects"`
+	RedirectsHistory   []RedirectHistory `bson:"redirectshistory"`
+	CreatedUnix        int64             `bson:"createdunix"`
+	Region             string            `bson:"region"`
+	SubRegion          string            `bson:"subregion"`
+	ContentLength      int64             `bson:"contentlength"`
+	ResolvedIp         string            `bson:"resolvedip"`
+	ConnectTime        int64             `bson:"connecttime"`
+	TlsHandshakeTime   int64             `bson:"tlshandshaketime"`
+	TtfbTime           int64             `bson:"ttfbtime"`
+	TransferTime       int64             `bson:"transfertime"`
+	FailedAssertion    string            `bson:"failedassertion"`
+	RobotsTxtExists    bool              `bson:"robotstxtexists"`
+	RobotsTxtBlocksAll bool              `bson:"robotstxtblocksall"`
+	RobotsTxtChanged   bool              `bson:"robotstxtchanged"`
+	RobotsTxtHash      string            `bson:"robotstxthash"`
+	TlsDaysToExpiry    int               `bson:"tlsdaystoexpiry"`
+	TlsNotAfterUnix    int64             `bson:"tlsnotafterunix"`
+	TlsIssuer          string            `bson:"tlsissuer"`
+	TlsSans            []string          `bson:"tlssans"`
+	TlsHostnameMatch   bool              `bson:"tlshostnamematch"`
+	TlsChainValid      bool              `bson:"tlschainvalid"`
+	DnsTime            int64             `bson:"dnstime"`
+	DnsAnswers         []string          `bson:"dnsanswers"`
+	Degraded           bool              `bson:"degraded"`
+	BodyTruncated      bool              `bson:"bodytruncated"`
+	AssertionsResults  []AssertionResult `bson:"assertionsresults"`
+	StepsResults       []HttpStepResult  `bson:"stepsresults"`
+	FailedStep         int               `bson:"failedstep"`
+	PingSent           int               `bson:"pingsent"`
+	PingReceived       int               `bson:"pingreceived"`
+	PingLossPerc       float64           `bson:"pinglossperc"`
+	PingMinTime        int64             `bson:"pingmintime"`
+	PingAvgTime        int64             `bson:"pingavgtime"`
+	PingMaxTime        int64             `bson:"pingmaxtime"`
+	PingJitter         int64             `bson:"pingjitter"`
+	MailBanner         string            `bson:"mailbanner"`
+	MailCapabilities   []string          `bson:"mailcapabilities"`
+	MailBannerTime     int64             `bson:"mailbannertime"`
+	MailStartTlsDone   bool              `bson:"mailstarttlsdone"`
+}
+
+// HttpAssertion is verified against the http response body, Path is used only by the json path assertions
+type HttpAssertion struct {
+	Type  string `bson:"type"`
+	Path  string `bson:"path"`
+	Value string `bson:"value"`
+}
+
+type AssertionResult struct {
+	Type   string `bson:"type"`
+	Path   string `bson:"path"`
+	Value  string `bson:"value"`
+	Actual string `bson:"actual"`
+	Passed bool   `bson:"passed"`
+	Error  string `bson:"error"`
+}
+
+// HttpStep is a single request of a transaction check
+type HttpStep struct {
+	Name             string               `bson:"name"`
+	Method           string               `bson:"method"`
+	Url              string               `bson:"url"`
+	HttpHeaders      [][]string           `bson:"httpheaders"`
+	HttpBody         string               `bson:"httpbody"`
+	HttpStatusCodeOK int                  `bson:"httpstatuscodeok"`
+	HttpAssertions   []HttpAssertion      `bson:"httpassertions"`
+	Extract          []HttpStepExtraction `bson:"extract"`
+}
+
+// HttpStepExtraction saves a value from the step response (Source HEADER, COOKIE or JSONPATH) to be used in the next steps as {{Name}}
+type HttpStepExtraction struct {
+	Name   string `bson:"name"`
+	Source string `bson:"source"`
+	Key    string `bson:"key"`
+}
+
+type HttpStepResult struct {
+	Name              string            `bson:"name"`
+	Method            string            `bson:"method"`
+	URL               string            `bson:"url"`
+	StatusCode        int               `bson:"statuscode"`
+	Success           bool              `bson:"success"`
+	TimeSpent         int64             `bson:"timespent"`
+	DnsTime           int64             `bson:"dnstime"`
+	ConnectTime       int64             `bson:"connecttime"`
+	TlsHandshakeTime  int64             `bson:"tlshandshaketime"`
+	TtfbTime          int64             `bson:"ttfbtime"`
+	TransferTime      int64             `bson:"transfertime"`
+	FailedAssertion   string            `bson:"failedassertion"`
+	Error             string            `bson:"error"`
+	AssertionsResults []AssertionResult `bson:"assertionsresults"`
 }
 
 type RedirectHistory struct {
@@ -117,6 +273,7 @@ const TablenameChecksStatus = "checks_status"
 const TablenameChecksStatusChanges = "checks_status_changes"
 const TablenameChecksInFlight = "checks_inflight"
 const TablenameHeartbeats = "heartbeats"
+const TablenameLeases = "leases"
 
 const DBDBNAME = "DBDBNAME"
 const DBCONNSTRING = "DBCONNSTRING"
@@ -149,6 +306,7 @@ func GetDefaultIndexModelsByCollectionName(c string) []mongo.IndexModel {
 		idxs = []mongo.IndexModel{
 			{Keys: bson.D{{"rid", 1}}, Options: &options.IndexOptions{Unique: &idxUnique, Name: &idxName}},
 			{Keys: bson.D{{"checkid", 1}}},
+			{Keys: bson.D{{"inflightsinceunix", 1}}},
 		}
 		break
 	case TablenameChecks:
@@ -171,6 +329,12 @@ func GetDefaultIndexModelsByCollectionName(c string) []mongo.IndexModel {
 			{Keys: bson.D{{"hostname", 1}, {"approle", 1}}, Options: &options.IndexOptions{Unique: &idxUnique}},
 			{Keys: bson.D{{"lasthb", 1}}},
 		}
+	case TablenameLeases:
+		idxUnique := true
+		idxName := "uk_name"
+		idxs = []mongo.IndexModel{
+			{Keys: bson.D{{"name", 1}}, Options: &options.IndexOptions{Unique: &idxUnique, Name: &idxName}},
+		}
 
 	}
 
@@ -1,14 +1,41 @@
 package internalstatusmonitorapi
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 )
 
+// apps can add their own information to the status, the function is called every time the status is requested
+var statusInfo = map[string]func() interface{}{}
+var statusInfoMutex = sync.Mutex{}
+
 func StartListener(port string, appRole string) {
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "{\"status\":\"OK\",\"appRole\":\"%s\"}", appRole)
+		status := map[string]interface{}{"status": "OK", "appRole": appRole}
+
+		statusInfoMutex.Lock()
+		for key, info := range statusInfo {
+			status[key] = info()
+		}
+		statusInfoMutex.Unlock()
+
+		response, err := json.Marshal(status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(response)
 	})
 
 	go http.ListenAndServe(fmt.Sprintf(":%s", port), nil)
 }
+
+// AddStatusInfo adds the value returned by the function to the status, with the key passed
+func AddStatusInfo(key string, info func() interface{}) {
+	statusInfoMutex.Lock()
+	defer statusInfoMutex.Unlock()
+
+	statusInfo[key] = info
+}
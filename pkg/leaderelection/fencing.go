@@ -0,0 +1,71 @@
+package leaderelection
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// the work produced by a leader carries the name of the lease held and its fencing token, who receives the work (the workers)
+// compares the token with the current token of the lease and refuses the work produced by a leader after it has been replaced.
+// Work with an older token produced before the lease changed holder was legit when produced (the new leader didn't exist yet
+// and won't produce it again), so it's accepted: only the work produced since the lease was acquired by the new leader is refused.
+// The current tokens are cached to avoid reading the lease for every request, a token newer than the cached one refreshes the cache.
+// A leader replaced can still get some work accepted until the cache is refreshed, keep the refresh below the lease duration
+
+type fencingTokenCacheType struct {
+	token       int64
+	acquiredAt  time.Time
+	refreshedAt time.Time
+}
+
+type FencingValidatorType struct {
+	store   LeaseStoreType
+	refresh time.Duration
+	mutex   sync.Mutex
+	tokens  map[string]fencingTokenCacheType
+}
+
+// NewFencingValidator creates the validator of the tokens of the leases kept in the db collection passed
+func NewFencingValidator(refresh time.Duration, dbClient *mongo.Client, dbName string, dbCollection string) *FencingValidatorType {
+	return NewFencingValidatorWithStore(refresh, NewMongoLeaseStore(dbClient, dbName, dbCollection))
+}
+
+// NewFencingValidatorWithStore is like NewFencingValidator, with the leases kept in the store passed
+func NewFencingValidatorWithStore(refresh time.Duration, store LeaseStoreType) *FencingValidatorType {
+	return &FencingValidatorType{store: store, refresh: refresh, tokens: map[string]fencingTokenCacheType{}}
+}
+
+// Stale returns true if the token is older than the current token of the lease and the work has been produced (producedUnix)
+// after the current holder acquired the lease: the work has been produced by a leader already replaced.
+// Work without a lease name (produced before fencing was introduced) is never stale
+func (fv *FencingValidatorType) Stale(leaseName string, token int64, producedUnix int64) (bool, error) {
+	if leaseName == "" {
+		return false, nil
+	}
+
+	fv.mutex.Lock()
+	defer fv.mutex.Unlock()
+
+	cached, exists := fv.tokens[leaseName]
+	// a token newer than the cached one comes from a new leader, the cache is refreshed to know when it took over
+	if !exists || token > cached.token || time.Since(cached.refreshedAt) > fv.refresh {
+		ctx, cancel := context.WithTimeout(context.Background(), fv.refresh)
+		defer cancel()
+		lease, found, err := fv.store.Retrieve(ctx, leaseName)
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			// nothing to compare with, the lease could have been deleted to reset it
+			return false, nil
+		}
+		cached = fencingTokenCacheType{token: lease.FencingToken, acquiredAt: lease.AcquiredAt, refreshedAt: time.Now()}
+		fv.tokens[leaseName] = cached
+	}
+
+	// the time of the work has a precision of a second, work produced in the same second the lease was acquired is refused
+	return token < cached.token && producedUnix >= cached.acquiredAt.Unix(), nil
+}
@@ -0,0 +1,178 @@
+package leaderelection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Only one instance of an app (the scheduler for example) can be active, the others are on standby ready to take over.
+// The active instance holds a lease, a document in the db with an expiry time that the leader keeps renewing.
+// When the leader stops renewing (crash, network partition...) the lease expires and one of the standby instances acquires it.
+//
+// Expiry times are calculated using the clock of the db server ($$NOW) so clocks not in sync between hosts are not a problem.
+// Every time the lease changes holder the fencing token is increased and the acquisition time recorded, the token is stamped on the
+// work produced by the leader so work coming from a previous leader that doesn't know yet it has been replaced can be recognised.
+// Who receives the work checks the token with a FencingValidatorType.
+//
+// The leader considers itself leader only until the lease it renewed expires (measured with the local clock from the moment the
+// renewal was sent), if it can't renew in time it steps down before a standby instance is able to acquire the lease.
+
+// a renewal is a round trip to the db, a lease shorter than this would expire before being renewed
+const MINLEASEDURATION = time.Second
+
+type LeaderElectionType struct {
+	leaseName     string
+	holderId      string
+	leaseDuration time.Duration
+	renewInterval time.Duration
+	store         LeaseStoreType
+	mutex         sync.RWMutex
+	leader        bool
+	fencingToken  int64
+	leaderUntil   time.Time
+	chDone        chan bool
+	running       bool
+}
+
+type LeaseDBType struct {
+	Name         string    `bson:"name"`
+	Holder       string    `bson:"holder"`
+	FencingToken int64     `bson:"fencingtoken"`
+	AcquiredAt   time.Time `bson:"acquiredat"`
+	ExpiresAt    time.Time `bson:"expiresat"`
+	RenewedAt    time.Time `bson:"renewedat"`
+}
+
+// Start tries to acquire the lease immediately and keeps renewing (or trying to acquire) it in the background
+func (le *LeaderElectionType) Start() {
+	if le.running {
+		return
+	}
+	le.running = true
+	le.chDone = make(chan bool)
+	le.tryAcquireOrRenew()
+	go le.electionRoutine()
+}
+
+// Stop releases the lease (if held), so a standby instance can take over without waiting for the lease to expire
+func (le *LeaderElectionType) Stop() {
+	if !le.running {
+		return
+	}
+	le.chDone <- true
+	le.running = false
+	le.release()
+}
+
+// Leadership returns true if the instance is the leader, with the fencing token of the lease held
+func (le *LeaderElectionType) Leadership() (bool, int64) {
+	le.mutex.RLock()
+	defer le.mutex.RUnlock()
+
+	if !le.leader || time.Now().After(le.leaderUntil) {
+		return false, 0
+	}
+
+	return true, le.fencingToken
+}
+
+func (le *LeaderElectionType) GetHolderId() string {
+	return le.holderId
+}
+
+func (le *LeaderElectionType) GetLeaseName() string {
+	return le.leaseName
+}
+
+func (le *LeaderElectionType) electionRoutine() {
+	ticker := time.NewTicker(le.renewInterval)
+	for {
+		select {
+		case <-le.chDone:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			le.tryAcquireOrRenew()
+		}
+	}
+}
+
+// tryAcquireOrRenew renews the lease if held by this instance or acquires it if expired, in a single update
+func (le *LeaderElectionType) tryAcquireOrRenew() {
+	// the lease is valid (from our point of view) starting from the moment the request is sent, not when the response is received
+	sentAt := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), le.renewInterval)
+	defer cancel()
+	lease, err := le.store.AcquireOrRenew(ctx, le.leaseName, le.holderId, le.leaseDuration)
+	if err != nil {
+		if errors.Is(err, ErrLeaseHeld) {
+			le.stepDown(err.Error())
+			return
+		}
+		// can't tell if we are still the leader, we keep the leadership until the lease renewed the last time expires
+		fmt.Printf("Error while renewing lease [%s]: %s\n", le.leaseName, err.Error())
+		return
+	}
+
+	le.mutex.Lock()
+	if !le.leader || le.fencingToken != lease.FencingToken {
+		fmt.Printf("Lease [%s] acquired by [%s] with fencing token %d\n", le.leaseName, le.holderId, lease.FencingToken)
+	}
+	le.leader = true
+	le.fencingToken = lease.FencingToken
+	le.leaderUntil = sentAt.Add(le.leaseDuration)
+	le.mutex.Unlock()
+}
+
+func (le *LeaderElectionType) stepDown(reason string) {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+
+	if le.leader {
+		fmt.Printf("Lease [%s] lost by [%s]: %s\n", le.leaseName, le.holderId, reason)
+	}
+	le.leader = false
+	le.fencingToken = 0
+}
+
+func (le *LeaderElectionType) release() {
+	le.stepDown("released")
+
+	err := le.store.Release(context.Background(), le.leaseName, le.holderId)
+	if err != nil {
+		fmt.Printf("Error while releasing lease [%s]: %s\n", le.leaseName, err.Error())
+	}
+}
+
+// New creates the participant to the election of the lease name, each participant needs a unique holder id
+// the lease is renewed every renew interval, a standby instance takes over within lease duration + renew interval
+func New(leaseName string, holderId string, leaseDuration time.Duration, renewInterval time.Duration, dbClient *mongo.Client, dbName string, dbCollection string) (*LeaderElectionType, error) {
+	return NewWithStore(leaseName, holderId, leaseDuration, renewInterval, NewMongoLeaseStore(dbClient, dbName, dbCollection))
+}
+
+// NewWithStore is like New, with the leases kept in the store passed
+func NewWithStore(leaseName string, holderId string, leaseDuration time.Duration, renewInterval time.Duration, store LeaseStoreType) (*LeaderElectionType, error) {
+	le := LeaderElectionType{}
+
+	// a missing setting is read as 0, without these checks the ticker of the election routine would panic
+	if leaseDuration < MINLEASEDURATION {
+		return nil, errors.New(fmt.Sprintf("lease [%s] duration %s is not valid, it needs to be at least %s", leaseName, leaseDuration, MINLEASEDURATION))
+	}
+	if renewInterval <= 0 || renewInterval >= leaseDuration {
+		return nil, errors.New(fmt.Sprintf("lease [%s] renew interval %s is not valid, it needs to be shorter than the lease duration %s", leaseName, renewInterval, leaseDuration))
+	}
+
+	le.leaseName = leaseName
+	le.holderId = holderId
+	le.leaseDuration = leaseDuration
+	le.renewInterval = renewInterval
+	le.store = store
+
+	return &le, nil
+}
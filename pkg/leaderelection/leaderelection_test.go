@@ -0,0 +1,208 @@
+package leaderelection
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewRejectsLeaseTooShort(t *testing.T) {
+	for _, d := range []time.Duration{0, -time.Second, 3 * time.Millisecond, 999 * time.Millisecond} {
+		le, err := New("scheduler", "holder", d, d/3, nil, "db", "leases")
+		if err == nil || le != nil {
+			t.Fatalf("expected lease duration %s to be rejected", d)
+		}
+	}
+	for _, renew := range []time.Duration{0, -time.Second, MINLEASEDURATION, 2 * MINLEASEDURATION} {
+		le, err := New("scheduler", "holder", MINLEASEDURATION, renew, nil, "db", "leases")
+		if err == nil || le != nil {
+			t.Fatalf("expected renew interval %s to be rejected", renew)
+		}
+	}
+
+	le, err := New("scheduler", "holder", MINLEASEDURATION, MINLEASEDURATION/3, nil, "db", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if le.renewInterval != MINLEASEDURATION/3 {
+		t.Fatalf("expected renew interval of %s, got %s", MINLEASEDURATION/3, le.renewInterval)
+	}
+}
+
+// memoryLeaseStoreType keeps the leases in memory, with the same rules of the db store
+type memoryLeaseStoreType struct {
+	mutex  sync.Mutex
+	leases map[string]LeaseDBType
+}
+
+func newMemoryLeaseStore() *memoryLeaseStoreType {
+	return &memoryLeaseStoreType{leases: map[string]LeaseDBType{}}
+}
+
+func (ms *memoryLeaseStoreType) AcquireOrRenew(ctx context.Context, leaseName string, holderId string, leaseDuration time.Duration) (LeaseDBType, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := time.Now()
+	lease, exists := ms.leases[leaseName]
+	if exists && lease.Holder != holderId && !lease.ExpiresAt.Before(now) {
+		return LeaseDBType{}, ErrLeaseHeld
+	}
+	if lease.Holder != holderId {
+		lease.FencingToken++
+		lease.AcquiredAt = now
+	}
+	lease.Name = leaseName
+	lease.Holder = holderId
+	lease.ExpiresAt = now.Add(leaseDuration)
+	lease.RenewedAt = now
+	ms.leases[leaseName] = lease
+
+	return lease, nil
+}
+
+func (ms *memoryLeaseStoreType) Release(ctx context.Context, leaseName string, holderId string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if lease, exists := ms.leases[leaseName]; exists && lease.Holder == holderId {
+		lease.ExpiresAt = time.Now()
+		ms.leases[leaseName] = lease
+	}
+
+	return nil
+}
+
+// expire simulates the holder of the lease not renewing it in time
+func (ms *memoryLeaseStoreType) expire(leaseName string) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	lease := ms.leases[leaseName]
+	lease.ExpiresAt = time.Now().Add(-time.Millisecond)
+	ms.leases[leaseName] = lease
+}
+
+func (ms *memoryLeaseStoreType) Retrieve(ctx context.Context, leaseName string) (LeaseDBType, bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	lease, exists := ms.leases[leaseName]
+
+	return lease, exists, nil
+}
+
+func newTestElection(t *testing.T, store LeaseStoreType, leaseName string, holderId string) *LeaderElectionType {
+	le, err := NewWithStore(leaseName, holderId, MINLEASEDURATION, MINLEASEDURATION/3, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return le
+}
+
+func TestTakeoverRefusesWorkOfPreviousLeader(t *testing.T) {
+	store := newMemoryLeaseStore()
+	validator := NewFencingValidatorWithStore(time.Hour, store)
+	scheduler1 := newTestElection(t, store, "scheduler", "scheduler1")
+	scheduler2 := newTestElection(t, store, "scheduler", "scheduler2")
+
+	scheduler1.tryAcquireOrRenew()
+	scheduler2.tryAcquireOrRenew()
+	isLeader1, token1 := scheduler1.Leadership()
+	isLeader2, _ := scheduler2.Leadership()
+	if !isLeader1 || isLeader2 {
+		t.Fatalf("expected scheduler1 to be the only leader, got %v %v", isLeader1, isLeader2)
+	}
+	if stale, _ := validator.Stale("scheduler", token1, time.Now().Unix()); stale {
+		t.Fatal("work of the current leader refused")
+	}
+
+	// scheduler1 stops renewing (paused, partitioned...) and its lease expires
+	scheduler1.leaderUntil = time.Now()
+	store.expire("scheduler")
+	if isLeader1, _ = scheduler1.Leadership(); isLeader1 {
+		t.Fatal("scheduler1 still leader after its lease expired")
+	}
+	scheduler2.tryAcquireOrRenew()
+	isLeader2, token2 := scheduler2.Leadership()
+	if !isLeader2 || token2 <= token1 {
+		t.Fatalf("expected scheduler2 to take over with a newer token, got %v %d (previous %d)", isLeader2, token2, token1)
+	}
+
+	// the work of scheduler2 is accepted, as the work produced by scheduler1 while it was the leader.
+	// The work produced by scheduler1 after scheduler2 took over is refused
+	if stale, _ := validator.Stale("scheduler", token2, time.Now().Unix()); stale {
+		t.Fatal("work of the new leader refused")
+	}
+	if stale, _ := validator.Stale("scheduler", token1, time.Now().Add(-2*time.Second).Unix()); stale {
+		t.Fatal("work produced by the previous leader before the takeover refused")
+	}
+	if stale, _ := validator.Stale("scheduler", token1, time.Now().Unix()); !stale {
+		t.Fatal("work produced by the previous leader after the takeover accepted")
+	}
+
+	// scheduler1 comes back and finds the lease held
+	scheduler1.tryAcquireOrRenew()
+	if isLeader1, _ = scheduler1.Leadership(); isLeader1 {
+		t.Fatal("scheduler1 leader again while scheduler2 holds the lease")
+	}
+}
+
+func TestStaleTokenRefusedAfterCacheRefresh(t *testing.T) {
+	store := newMemoryLeaseStore()
+	validator := NewFencingValidatorWithStore(10*time.Millisecond, store)
+	scheduler1 := newTestElection(t, store, "scheduler", "scheduler1")
+	scheduler2 := newTestElection(t, store, "scheduler", "scheduler2")
+
+	scheduler1.tryAcquireOrRenew()
+	_, token1 := scheduler1.Leadership()
+	if stale, _ := validator.Stale("scheduler", token1, time.Now().Unix()); stale {
+		t.Fatal("work of the current leader refused")
+	}
+
+	// scheduler1 releases the lease, scheduler2 takes over but the validator doesn't see any of its work yet
+	scheduler1.release()
+	scheduler2.tryAcquireOrRenew()
+	time.Sleep(20 * time.Millisecond)
+
+	if stale, _ := validator.Stale("scheduler", token1, time.Now().Unix()); !stale {
+		t.Fatal("work of the previous leader accepted after the cache refresh")
+	}
+	if stale, _ := validator.Stale("", 0, time.Now().Unix()); stale {
+		t.Fatal("work without a lease refused")
+	}
+}
+
+func TestShardLeasesAreFencedIndependently(t *testing.T) {
+	store := newMemoryLeaseStore()
+	validator := NewFencingValidatorWithStore(time.Hour, store)
+
+	// two schedulers, each holding the lease of its shard
+	shard1 := newTestElection(t, store, "scheduler.host1", "host1--a")
+	shard2 := newTestElection(t, store, "scheduler.host2", "host2--a")
+	shard1.tryAcquireOrRenew()
+	shard2.tryAcquireOrRenew()
+	holds1, token1 := shard1.Leadership()
+	holds2, token2 := shard2.Leadership()
+	if !holds1 || !holds2 {
+		t.Fatalf("expected both schedulers to hold their shard lease, got %v %v", holds1, holds2)
+	}
+
+	// host1 restarts, the new process takes the shard over
+	shard1.release()
+	restarted := newTestElection(t, store, "scheduler.host1", "host1--b")
+	restarted.tryAcquireOrRenew()
+	_, tokenRestarted := restarted.Leadership()
+
+	if stale, _ := validator.Stale("scheduler.host1", tokenRestarted, time.Now().Unix()); stale {
+		t.Fatal("work of the restarted process refused")
+	}
+	if stale, _ := validator.Stale("scheduler.host1", token1, time.Now().Unix()); !stale {
+		t.Fatal("work of the process replaced accepted")
+	}
+	if stale, _ := validator.Stale("scheduler.host2", token2, time.Now().Unix()); stale {
+		t.Fatal("work of the other shard refused")
+	}
+}
@@ -0,0 +1,94 @@
+package leaderelection
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the leases are kept in the db, the store is an interface so the election can run against something else (tests)
+
+var ErrLeaseHeld = errors.New("lease held by another instance")
+
+type LeaseStoreType interface {
+	// AcquireOrRenew renews the lease if held by the holder or acquires it if expired, ErrLeaseHeld if held by another holder
+	// the fencing token is increased, and the acquisition time recorded, every time the lease changes holder
+	AcquireOrRenew(ctx context.Context, leaseName string, holderId string, leaseDuration time.Duration) (LeaseDBType, error)
+	// Release expires the lease immediately, if still held by the holder
+	Release(ctx context.Context, leaseName string, holderId string) error
+	// Retrieve returns the lease, false if it has never been acquired
+	Retrieve(ctx context.Context, leaseName string) (LeaseDBType, bool, error)
+}
+
+type mongoLeaseStoreType struct {
+	dbClient     *mongo.Client
+	dbName       string
+	dbCollection string
+}
+
+// NewMongoLeaseStore returns the store keeping the leases in the db collection passed, the lease name needs a unique index
+func NewMongoLeaseStore(dbClient *mongo.Client, dbName string, dbCollection string) LeaseStoreType {
+	return &mongoLeaseStoreType{dbClient: dbClient, dbName: dbName, dbCollection: dbCollection}
+}
+
+func (ms *mongoLeaseStoreType) AcquireOrRenew(ctx context.Context, leaseName string, holderId string, leaseDuration time.Duration) (LeaseDBType, error) {
+	var lease LeaseDBType
+
+	filter := bson.M{
+		"name": leaseName,
+		"$or": bson.A{
+			bson.M{"holder": holderId},
+			bson.M{"$expr": bson.M{"$lt": bson.A{"$expiresat", "$$NOW"}}},
+		},
+	}
+	update := bson.A{bson.M{"$set": bson.M{
+		"fencingtoken": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$holder", holderId}},
+			"$fencingtoken",
+			bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$fencingtoken", 0}}, 1}},
+		}},
+		"acquiredat": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$holder", holderId}},
+			bson.M{"$ifNull": bson.A{"$acquiredat", "$$NOW"}},
+			"$$NOW",
+		}},
+		"holder":    holderId,
+		"expiresat": bson.M{"$add": bson.A{"$$NOW", leaseDuration.Milliseconds()}},
+		"renewedat": "$$NOW",
+	}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	err := ms.dbClient.Database(ms.dbName).Collection(ms.dbCollection).FindOneAndUpdate(ctx, filter, update, opts).Decode(&lease)
+	// the upsert fails because the lease document already exists
+	if mongo.IsDuplicateKeyError(err) || errors.Is(err, mongo.ErrNoDocuments) {
+		return lease, ErrLeaseHeld
+	}
+
+	return lease, err
+}
+
+func (ms *mongoLeaseStoreType) Release(ctx context.Context, leaseName string, holderId string) error {
+	filter := bson.M{"name": leaseName, "holder": holderId}
+	update := bson.A{bson.M{"$set": bson.M{"expiresat": "$$NOW"}}}
+	_, err := ms.dbClient.Database(ms.dbName).Collection(ms.dbCollection).UpdateOne(ctx, filter, update)
+
+	return err
+}
+
+func (ms *mongoLeaseStoreType) Retrieve(ctx context.Context, leaseName string) (LeaseDBType, bool, error) {
+	var lease LeaseDBType
+
+	err := ms.dbClient.Database(ms.dbName).Collection(ms.dbCollection).FindOne(ctx, bson.M{"name": leaseName}).Decode(&lease)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return lease, false, nil
+	}
+	if err != nil {
+		return lease, false, err
+	}
+
+	return lease, true, nil
+}
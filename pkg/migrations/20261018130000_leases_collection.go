@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"brainyping/pkg/dbhelper"
+
+	"github.com/flevanti/bisonmigration"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//
+// Please return an error if you want the migration to fail and the migration process to stop.
+// Migration failed will continue to be pending ( or won't be rolled back if it was a down process)
+// Don't exit, panic or try any other way to stop the process.
+//
+// just return a nice error
+//
+//
+// IMPORTANT FOR SAFETY REASONS AND AVOID STUPID CONFLICTS:
+//
+// DO NOT CREATE EXPORTED FUNCTIONS
+// (translated, create only functions that start with lowercase characters)
+//
+// REMEMBER THAT ALL MIGRATIONS EXIST IN THE SAME PACKAGE, AVOID CREATING GLOBAL VARIABLES TO AVOID UNEXPECTED/HORRIBLE ERRORS
+// IF YOU NEED GLOBAL VARIABLE MAKE SURE THEIR NAME IS UNIQUE, A GOOD IDEA IS TO USE THE MIGRATION SEQUENCE AS SUFFIX
+// YOU HAVE BEEN WARNED
+
+func up_20261018130000(db *mongo.Client) error {
+	if !dbhelper.CheckIfCollectionExists(db, dbhelper.GetDatabaseName(), dbhelper.TablenameLeases) {
+		err := dbhelper.CreateCollection(db, dbhelper.GetDatabaseName(), dbhelper.TablenameLeases, &options.CreateCollectionOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	// the unique name is what prevents two instances from creating the same lease at the same time
+	return dbhelper.CreateIndexes(db, dbhelper.GetDatabaseName(), dbhelper.TablenameLeases, dbhelper.GetDefaultIndexModelsByCollectionName(dbhelper.TablenameLeases))
+}
+
+func down_20261018130000(db *mongo.Client) error {
+	if dbhelper.CheckIfCollectionExists(db, dbhelper.GetDatabaseName(), dbhelper.TablenameLeases) {
+		return dbhelper.DeleteCollection(db, dbhelper.GetDatabaseName(), dbhelper.TablenameLeases)
+	}
+	return nil
+}
+
+//
+//
+// DON'T TOUCH ANYTHING BEYOND THIS POINT
+//
+//
+
+//
+// this is adding the migration to the migration engine
+//
+func init() {
+	bisonmigration.RegisterMigration(20261018130000, "leases_collection", "*DEFAULT*", up_20261018130000, down_20261018130000)
+}
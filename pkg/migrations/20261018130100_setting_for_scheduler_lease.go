@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"brainyping/pkg/settings"
+
+	"github.com/flevanti/bisonmigration"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//
+// Please return an error if you want the migration to fail and the migration process to stop.
+// Migration failed will continue to be pending ( or won't be rolled back if it was a down process)
+// Don't exit, panic or try any other way to stop the process.
+//
+// just return a nice error
+//
+//
+// IMPORTANT FOR SAFETY REASONS AND AVOID STUPID CONFLICTS:
+//
+// DO NOT CREATE EXPORTED FUNCTIONS
+// (translated, create only functions that start with lowercase characters)
+//
+// REMEMBER THAT ALL MIGRATIONS EXIST IN THE SAME PACKAGE, AVOID CREATING GLOBAL VARIABLES TO AVOID UNEXPECTED/HORRIBLE ERRORS
+// IF YOU NEED GLOBAL VARIABLE MAKE SURE THEIR NAME IS UNIQUE, A GOOD IDEA IS TO USE THE MIGRATION SEQUENCE AS SUFFIX
+// YOU HAVE BEEN WARNED
+
+func up_20261018130100(db *mongo.Client) error {
+	_ = down_20261018130100(db) // remove keys before setting them to be sure they do not exist
+	settings.SaveNewSettFriendly("SCH_LEASE_DURATION_MS", "15000", "how long the lease of the active scheduler lasts without being renewed, a standby scheduler takes over within this time (plus a third of it). At least 1000")
+	return nil
+}
+
+func down_20261018130100(db *mongo.Client) error {
+	settings.DeleteSettingByKey("SCH_LEASE_DURATION_MS")
+	return nil
+}
+
+//
+//
+// DON'T TOUCH ANYTHING BEYOND THIS POINT
+//
+//
+
+//
+// this is adding the migration to the migration engine
+//
+func init() {
+	bisonmigration.RegisterMigration(20261018130100, "setting_for_scheduler_lease", "*DEFAULT*", up_20261018130100, down_20261018130100)
+}
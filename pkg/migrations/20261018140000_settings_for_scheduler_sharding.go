@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"brainyping/pkg/settings"
+
+	"github.com/flevanti/bisonmigration"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//
+// Please return an error if you want the migration to fail and the migration process to stop.
+// Migration failed will continue to be pending ( or won't be rolled back if it was a down process)
+// Don't exit, panic or try any other way to stop the process.
+//
+// just return a nice error
+//
+//
+// IMPORTANT FOR SAFETY REASONS AND AVOID STUPID CONFLICTS:
+//
+// DO NOT CREATE EXPORTED FUNCTIONS
+// (translated, create only functions that start with lowercase characters)
+//
+// REMEMBER THAT ALL MIGRATIONS EXIST IN THE SAME PACKAGE, AVOID CREATING GLOBAL VARIABLES TO AVOID UNEXPECTED/HORRIBLE ERRORS
+// IF YOU NEED GLOBAL VARIABLE MAKE SURE THEIR NAME IS UNIQUE, A GOOD IDEA IS TO USE THE MIGRATION SEQUENCE AS SUFFIX
+// YOU HAVE BEEN WARNED
+
+func up_20261018140000(db *mongo.Client) error {
+	_ = down_20261018140000(db) // remove keys before setting them to be sure they do not exist
+	settings.SaveNewSettFriendly("SCH_SHARDING_ENABLED", "0", "1 to split the checks between the scheduler instances alive, 0 to have all the checks in every instance and only the leader queueing them")
+	settings.SaveNewSettFriendly("SCH_SHARDS_REFRESH_MS", "15000", "how often the scheduler looks for instances joining or leaving to rebalance the checks when sharding is enabled, 0 disables the rebalance")
+	return nil
+}
+
+func down_20261018140000(db *mongo.Client) error {
+	settings.DeleteSettingByKey("SCH_SHARDING_ENABLED")
+	settings.DeleteSettingByKey("SCH_SHARDS_REFRESH_MS")
+	return nil
+}
+
+//
+//
+// DON'T TOUCH ANYTHING BEYOND THIS POINT
+//
+//
+
+//
+// this is adding the migration to the migration engine
+//
+func init() {
+	bisonmigration.RegisterMigration(20261018140000, "settings_for_scheduler_sharding", "*DEFAULT*", up_20261018140000, down_20261018140000)
+}
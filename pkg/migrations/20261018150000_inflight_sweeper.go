@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"brainyping/pkg/dbhelper"
+	"brainyping/pkg/settings"
+
+	"github.com/flevanti/bisonmigration"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//
+// Please return an error if you want the migration to fail and the migration process to stop.
+// Migration failed will continue to be pending ( or won't be rolled back if it was a down process)
+// Don't exit, panic or try any other way to stop the process.
+//
+// just return a nice error
+//
+//
+// IMPORTANT FOR SAFETY REASONS AND AVOID STUPID CONFLICTS:
+//
+// DO NOT CREATE EXPORTED FUNCTIONS
+// (translated, create only functions that start with lowercase characters)
+//
+// REMEMBER THAT ALL MIGRATIONS EXIST IN THE SAME PACKAGE, AVOID CREATING GLOBAL VARIABLES TO AVOID UNEXPECTED/HORRIBLE ERRORS
+// IF YOU NEED GLOBAL VARIABLE MAKE SURE THEIR NAME IS UNIQUE, A GOOD IDEA IS TO USE THE MIGRATION SEQUENCE AS SUFFIX
+// YOU HAVE BEEN WARNED
+
+func up_20261018150000(db *mongo.Client) error {
+	_ = down_20261018150000(db) // remove keys before setting them to be sure they do not exist
+	settings.SaveNewSettFriendly("SCH_INFLIGHT_SWEEP_MS", "60000", "how often the scheduler looks for requests lost in flight, 0 disables the sweeper")
+	settings.SaveNewSettFriendly("SCH_INFLIGHT_TIMEOUT_MS", "300000", "how long a request can be in flight before being considered lost")
+	settings.SaveNewSettFriendly("SCH_INFLIGHT_MAX_REQUEUES", "1", "how many times a request lost in flight is queued again to another region before timing out")
+
+	// the sweeper looks for the oldest requests in flight
+	indexModels := []mongo.IndexModel{{Keys: bson.D{{"inflightsinceunix", 1}}}}
+	return dbhelper.CreateIndexes(db, dbhelper.GetDatabaseName(), dbhelper.TablenameChecksInFlight, indexModels)
+}
+
+func down_20261018150000(db *mongo.Client) error {
+	settings.DeleteSettingByKey("SCH_INFLIGHT_SWEEP_MS")
+	settings.DeleteSettingByKey("SCH_INFLIGHT_TIMEOUT_MS")
+	settings.DeleteSettingByKey("SCH_INFLIGHT_MAX_REQUEUES")
+	return nil
+}
+
+//
+//
+// DON'T TOUCH ANYTHING BEYOND THIS POINT
+//
+//
+
+//
+// this is adding the migration to the migration engine
+//
+func init() {
+	bisonmigration.RegisterMigration(20261018150000, "inflight_sweeper", "*DEFAULT*", up_20261018150000, down_20261018150000)
+}
@@ -0,0 +1,56 @@
+package migrations
+
+import (
+	"brainyping/pkg/settings"
+
+	"github.com/flevanti/bisonmigration"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//
+// Please return an error if you want the migration to fail and the migration process to stop.
+// Migration failed will continue to be pending ( or won't be rolled back if it was a down process)
+// Don't exit, panic or try any other way to stop the process.
+//
+// just return a nice error
+//
+//
+// IMPORTANT FOR SAFETY REASONS AND AVOID STUPID CONFLICTS:
+//
+// DO NOT CREATE EXPORTED FUNCTIONS
+// (translated, create only functions that start with lowercase characters)
+//
+// REMEMBER THAT ALL MIGRATIONS EXIST IN THE SAME PACKAGE, AVOID CREATING GLOBAL VARIABLES TO AVOID UNEXPECTED/HORRIBLE ERRORS
+// IF YOU NEED GLOBAL VARIABLE MAKE SURE THEIR NAME IS UNIQUE, A GOOD IDEA IS TO USE THE MIGRATION SEQUENCE AS SUFFIX
+// YOU HAVE BEEN WARNED
+
+func up_20261018160000(db *mongo.Client) error {
+	_ = down_20261018160000(db) // remove keys before setting them to be sure they do not exist
+	settings.SaveNewSettFriendly("SCH_BACKPRESSURE_REFRESH_MS", "5000", "how often the scheduler reads the depth of the requests queues, 0 disables the backpressure")
+	settings.SaveNewSettFriendly("SCH_BACKPRESSURE_MAX_DEPTH", "10000", "requests waiting in a queue above which the queue is considered backed up, 0 disables the backpressure")
+	settings.SaveNewSettFriendly("SCH_BACKPRESSURE_POLICY", "REROUTE", "what to do with the requests for a backed up queue: SKIP (record a not executed response), REROUTE (to another region of the check, skip if none) or PUBLISH (send anyway)")
+	// the requests queues are now declared with a dead letter exchange, queues declared before need to be deleted (when empty) to be declared again
+	settings.SaveNewSettFriendly("QUEUE_REQUEST_TTL_MS", "0", "requests waiting in a queue longer than this are dead-lettered instead of being run late, 0 disables the ttl. It applies to the requests queued after the change")
+	return nil
+}
+
+func down_20261018160000(db *mongo.Client) error {
+	settings.DeleteSettingByKey("SCH_BACKPRESSURE_REFRESH_MS")
+	settings.DeleteSettingByKey("SCH_BACKPRESSURE_MAX_DEPTH")
+	settings.DeleteSettingByKey("SCH_BACKPRESSURE_POLICY")
+	settings.DeleteSettingByKey("QUEUE_REQUEST_TTL_MS")
+	return nil
+}
+
+//
+//
+// DON'T TOUCH ANYTHING BEYOND THIS POINT
+//
+//
+
+//
+// this is adding the migration to the migration engine
+//
+func init() {
+	bisonmigration.RegisterMigration(20261018160000, "settings_for_backpressure", "*DEFAULT*", up_20261018160000, down_20261018160000)
+}
@@ -0,0 +1,55 @@
+package migrations
+
+import (
+	"brainyping/pkg/settings"
+
+	"github.com/flevanti/bisonmigration"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//
+// Please return an error if you want the migration to fail and the migration process to stop.
+// Migration failed will continue to be pending ( or won't be rolled back if it was a down process)
+// Don't exit, panic or try any other way to stop the process.
+//
+// just return a nice error
+//
+//
+// IMPORTANT FOR SAFETY REASONS AND AVOID STUPID CONFLICTS:
+//
+// DO NOT CREATE EXPORTED FUNCTIONS
+// (translated, create only functions that start with lowercase characters)
+//
+// REMEMBER THAT ALL MIGRATIONS EXIST IN THE SAME PACKAGE, AVOID CREATING GLOBAL VARIABLES TO AVOID UNEXPECTED/HORRIBLE ERRORS
+// IF YOU NEED GLOBAL VARIABLE MAKE SURE THEIR NAME IS UNIQUE, A GOOD IDEA IS TO USE THE MIGRATION SEQUENCE AS SUFFIX
+// YOU HAVE BEEN WARNED
+
+func up_20261018170000(db *mongo.Client) error {
+	_ = down_20261018170000(db) // remove keys before setting them to be sure they do not exist
+	settings.SaveNewSettFriendly("SCH_PUBLISH_RETRIES", "3", "how many times the outbox replay is retried with a backoff after a failure, before going back to SCH_OUTBOX_REPLAY_MS")
+	settings.SaveNewSettFriendly("SCH_PUBLISH_BACKOFF_MS", "200", "time before the first outbox replay retry, doubled at each retry")
+	settings.SaveNewSettFriendly("SCH_OUTBOX_SIZE", "10000", "requests kept by the scheduler while the broker is not reachable, the oldest are dropped when full. 0 disables the outbox")
+	settings.SaveNewSettFriendly("SCH_OUTBOX_REPLAY_MS", "5000", "how often the scheduler tries to publish the requests in the outbox, 0 disables the replay and the outbox")
+	return nil
+}
+
+func down_20261018170000(db *mongo.Client) error {
+	settings.DeleteSettingByKey("SCH_PUBLISH_RETRIES")
+	settings.DeleteSettingByKey("SCH_PUBLISH_BACKOFF_MS")
+	settings.DeleteSettingByKey("SCH_OUTBOX_SIZE")
+	settings.DeleteSettingByKey("SCH_OUTBOX_REPLAY_MS")
+	return nil
+}
+
+//
+//
+// DON'T TOUCH ANYTHING BEYOND THIS POINT
+//
+//
+
+//
+// this is adding the migration to the migration engine
+//
+func init() {
+	bisonmigration.RegisterMigration(20261018170000, "settings_for_scheduler_publishing", "*DEFAULT*", up_20261018170000, down_20261018170000)
+}
@@ -0,0 +1,49 @@
+package migrations
+
+import (
+	"brainyping/pkg/settings"
+
+	"github.com/flevanti/bisonmigration"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//
+// Please return an error if you want the migration to fail and the migration process to stop.
+// Migration failed will continue to be pending ( or won't be rolled back if it was a down process)
+// Don't exit, panic or try any other way to stop the process.
+//
+// just return a nice error
+//
+//
+// IMPORTANT FOR SAFETY REASONS AND AVOID STUPID CONFLICTS:
+//
+// DO NOT CREATE EXPORTED FUNCTIONS
+// (translated, create only functions that start with lowercase characters)
+//
+// REMEMBER THAT ALL MIGRATIONS EXIST IN THE SAME PACKAGE, AVOID CREATING GLOBAL VARIABLES TO AVOID UNEXPECTED/HORRIBLE ERRORS
+// IF YOU NEED GLOBAL VARIABLE MAKE SURE THEIR NAME IS UNIQUE, A GOOD IDEA IS TO USE THE MIGRATION SEQUENCE AS SUFFIX
+// YOU HAVE BEEN WARNED
+
+func up_20261018180000(db *mongo.Client) error {
+	_ = down_20261018180000(db) // remove keys before setting them to be sure they do not exist
+	settings.SaveNewSettFriendly("WRK_FENCING_REFRESH_MS", "5000", "how often workers read the fencing token of the scheduler leases, requests queued by a scheduler after it was replaced are refused. Keep it below SCH_LEASE_DURATION_MS, 0 disables the check")
+	return nil
+}
+
+func down_20261018180000(db *mongo.Client) error {
+	settings.DeleteSettingByKey("WRK_FENCING_REFRESH_MS")
+	return nil
+}
+
+//
+//
+// DON'T TOUCH ANYTHING BEYOND THIS POINT
+//
+//
+
+//
+// this is adding the migration to the migration engine
+//
+func init() {
+	bisonmigration.RegisterMigration(20261018180000, "setting_for_worker_fencing", "*DEFAULT*", up_20261018180000, down_20261018180000)
+}
@@ -64,6 +64,11 @@ const QUEUENAMEREQUEST = "QUEUENAME_REQUEST"
 const QUEUENAMERESPONSE = "QUEUENAME_RESPONSE"
 const QUEUEPREFETCHCOUNT = "QUEUE_PREFETCH_COUNT"
 
+// requests waiting in the queue longer than the ttl are moved to the dead letter queue instead of being run late
+// the ttl is set on each request published, the dead letter exchange is part of the queues arguments and it's always there
+// so changing the ttl doesn't change the queues, see declareRequestsQueue
+const QUEUEREQUESTTTLMS = "QUEUE_REQUEST_TTL_MS"
+
 type CheckRecordQueued struct {
 	Record                    dbhelper.CheckRecord        `bson:"record"`
 	RecordOutcome             dbhelper.CheckOutcomeRecord `bson:"recordoutcome"`
@@ -76,7 +81,15 @@ type CheckRecordQueued struct {
 	ReceivedByResponseHandler int64                       `bson:"receivedbyresponsehandler"`
 	ErrorFatal                string                      `bson:"errorfatal"`
 	RequestId                 string                      `bson:"requestid"`
+	RunId                     string                      `bson:"runid"`
+	RunRegions                int                         `bson:"runregions"`
+	FencingLease              string                      `bson:"fencinglease"`
+	FencingToken              int64                       `bson:"fencingtoken"`
+	InFlightRequeues          int                         `bson:"inflightrequeues"`
 	Attempts                  int                         `bson:"attempts"`
+	ConfirmationOf            string                      `bson:"confirmationof"`
+	ConfirmationsRequested    int                         `bson:"confirmationsrequested"`
+	ConfirmQuorum             int                         `bson:"confirmquorum"`
 }
 
 func InitQueueWorker(region string, subRegion string) error {
@@ -129,6 +142,8 @@ func InitQueueScheduler() error {
 	connectionPublisherInfo = connectionInfoType{}
 	connectionPublisherInfo.needRequestsQueue = true
 	connectionPublisherInfo.allRequestsQueuesNeeded = true
+	// the scheduler publishes a response for the requests lost in flight
+	connectionPublisherInfo.needResponseQueue = true
 	connectionPublisherInfo.isPublisher = true
 
 	return connectionPublisherInfo.initQueue()
@@ -190,23 +205,29 @@ func (ci *connectionInfoType) initQueuesRequests() error {
 	regions, err := settings.GetRegionsList()
 	utilities.FailOnError(err)
 
+	enabled := settings.EnabledSubRegions(regions)
+
 	for _, r := range regions {
-		// todo once system is stable implement here the check to verify that the region flag is enabled?
 		for _, sr := range r.SubRegions {
 			queueFullName := BuildRequestsQueueName(r.Id, sr.Id)
-			// todo once system is stable implement here the check to verify that the subregion flag is enabled?
 
 			// if declaring for a worker make sure we are declaring only the queue for the right region/subregion....
 			if ci.allRequestsQueuesNeeded == false && (ci.region != r.Id || ci.subRegion != sr.Id) {
 				continue
 			}
 
+			// the scheduler doesn't need the queues of disabled regions/subregions, it is not going to send them anything
+			// workers instead always declare their queue, a disabled subregion still has to be drained
+			if ci.allRequestsQueuesNeeded && !enabled[settings.SubRegionKey(r.Id, sr.Id)] {
+				continue
+			}
+
 			// TODO do we need to declare a queue even if we are only consuming it? it should already exists, created by "a publisher" before us... 🤔
 
 			// create the queue for the sub region. queue name is [queuebasename].[region].[subregion]
-			_, err := ci.queueBrokerChannel.QueueDeclare(queueFullName, true, false, false, false, nil)
+			err := ci.declareRequestsQueue(queueFullName)
 			if err != nil {
-				return err
+				return errors.New(fmt.Sprintf("unable to declare queue %s: %s", queueFullName, err.Error()))
 			}
 			fmt.Println(queueFullName)
 			// create queue bindings with topic exchange
@@ -225,9 +246,129 @@ func (ci *connectionInfoType) initQueuesRequests() error {
 		return errors.New("unable to declare any queue! is it a worker? is the region/subregion configured correctly")
 	}
 
+	// expired requests of all the regions end up in the same queue, the scheduler looks after them
+	if ci.allRequestsQueuesNeeded {
+		_, err = ci.queueBrokerChannel.QueueDeclare(BuildDeadLetterQueueName(), true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+		err = ci.queueBrokerChannel.QueueBind(BuildDeadLetterQueueName(), BuildDeadLetterQueueName(), "amq.direct", false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// declareRequestsQueue declares the requests queue with the dead letter exchange. The broker refuses to declare a queue that
+// already exists with different arguments (declared before the dead letter exchange was introduced): the queue is not touched,
+// it could have requests waiting and workers consuming it, it has to be deleted when empty before starting again
+func (ci *connectionInfoType) declareRequestsQueue(queueName string) error {
+	_, err := ci.queueBrokerChannel.QueueDeclare(queueName, true, false, false, false, requestsQueueArgs())
+	if isPreconditionFailed(err) {
+		return errors.New(fmt.Sprintf("queue %s exists without the dead letter exchange, delete it when empty and start again: %s", queueName, err.Error()))
+	}
+
+	return err
+}
+
+func isPreconditionFailed(err error) bool {
+	var amqpErr *amqp.Error
+
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed
+}
+
+// requestsQueueArgs returns the arguments of the requests queues, workers and scheduler need to declare the queues with the same arguments
+// they don't depend on any setting, requests are dead-lettered only if published with a ttl
+func requestsQueueArgs() amqp.Table {
+	return amqp.Table{
+		"x-dead-letter-exchange":    "amq.direct",
+		"x-dead-letter-routing-key": BuildDeadLetterQueueName(),
+	}
+}
+
+// RequestsQueueDepth returns the number of requests waiting in the queue of the region/subregion
+// the queue is declared passively, it has to exist already. The broker closes the channel when the passive declare fails
+// so the probe uses its own short lived channel, the publisher channel is not affected
+func RequestsQueueDepth(region string, subRegion string) (int, error) {
+	connectionPublisherInfo.channelMutex.Lock()
+	if !connectionPublisherInfo.usable() {
+		connectionPublisherInfo.channelMutex.Unlock()
+		return 0, errors.New("publisher connection not available")
+	}
+	probeChannel, err := connectionPublisherInfo.GetQueueBrokerConnection().Channel()
+	connectionPublisherInfo.channelMutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	defer probeChannel.Close()
+
+	queue, err := probeChannel.QueueDeclarePassive(BuildRequestsQueueName(region, subRegion), true, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return queue.Messages, nil
+}
+
+// RefreshRequestsQueues declares the requests queues again, used by the publisher when a region/subregion is enabled at runtime
+// declaring a queue that already exists has no effect
+func RefreshRequestsQueues() error {
+	connectionPublisherInfo.channelMutex.Lock()
+	defer connectionPublisherInfo.channelMutex.Unlock()
+
+	return connectionPublisherInfo.initQueuesRequests()
+}
+
+// DrainRequestsQueue removes the messages waiting in the requests queue of the region/subregion and passes them to the callback
+// a message is removed from the queue only if the callback is successful, otherwise it is put back and the draining stops
+func DrainRequestsQueue(region string, subRegion string, callback func(body []byte) error) (int, error) {
+	return drainQueue(BuildRequestsQueueName(region, subRegion), callback)
+}
+
+// DrainDeadLetterQueue removes the expired requests and passes them to the callback, like DrainRequestsQueue
+func DrainDeadLetterQueue(callback func(body []byte) error) (int, error) {
+	return drainQueue(BuildDeadLetterQueueName(), callback)
+}
+
+func drainQueue(queueName string, callback func(body []byte) error) (int, error) {
+	var drained int
+
+	for {
+		connectionPublisherInfo.channelMutex.Lock()
+		if !connectionPublisherInfo.usable() {
+			// the publisher reconnects while publishing, nothing to drain until then
+			connectionPublisherInfo.channelMutex.Unlock()
+			return drained, errors.New("publisher connection not available")
+		}
+		msg, ok, err := connectionPublisherInfo.GetQueueBrokerChannel().Get(queueName, false)
+		connectionPublisherInfo.channelMutex.Unlock()
+		if err != nil {
+			return drained, err
+		}
+		if !ok {
+			// queue empty
+			return drained, nil
+		}
+
+		// the callback is probably publishing so it can't be called while holding the channel mutex
+		err = callback(msg.Body)
+
+		connectionPublisherInfo.channelMutex.Lock()
+		if err != nil {
+			_ = msg.Nack(false, true)
+		} else {
+			err = msg.Ack(false)
+		}
+		connectionPublisherInfo.channelMutex.Unlock()
+		if err != nil {
+			return drained, err
+		}
+		drained++
+	}
+}
+
 func BuildRequestsQueueName(region, subRegion string) string {
 	queueBaseName := settings.GetSettStr(QUEUENAMEREQUEST)
 	if queueBaseName == "" {
@@ -236,6 +377,10 @@ func BuildRequestsQueueName(region, subRegion string) string {
 	return fmt.Sprintf("%s.%s.%s", queueBaseName, region, subRegion)
 }
 
+func BuildDeadLetterQueueName() string {
+	return fmt.Sprintf("%s.deadletter", settings.GetSettStr(QUEUENAMEREQUEST))
+}
+
 func BuildRequestsQueueBindingKey(region, subRegion string) string {
 	return fmt.Sprintf("%s.%s", region, subRegion)
 }
@@ -357,53 +502,81 @@ func GetConsumerChannel() chan amqp.Delivery {
 
 func PublishToQueueDirectly(queueName string, body []byte) error {
 	// when exchange is empty it will default to default direct exchange and use the key as the routing key that matches the queue name
-	return publish("", queueName, body)
+	return publish("", queueName, body, "")
 }
 
 func PublishToTopicExchange(topicKey string, body []byte) error {
 	// amq.topic is the default topic exchange
-	return publish("amq.topic", topicKey, body)
+	return publish("amq.topic", topicKey, body, "")
+}
+
+// PublishRequestToTopicExchange publishes a request with the ttl configured, requests not picked up in time are dead-lettered
+func PublishRequestToTopicExchange(topicKey string, body []byte) error {
+	var expiration string
+	if settings.GetSettInt(QUEUEREQUESTTTLMS) > 0 {
+		expiration = fmt.Sprint(settings.GetSettInt(QUEUEREQUESTTTLMS))
+	}
+	return publish("amq.topic", topicKey, body, expiration)
 }
 
-func publish(exchange string, key string, body []byte) error {
+func publish(exchange string, key string, body []byte, expiration string) error {
 	connectionPublisherInfo.channelMutex.Lock()
 	defer connectionPublisherInfo.channelMutex.Unlock()
-	err := connectionPublisherInfo.GetQueueBrokerChannel().Publish(exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{Body: body, DeliveryMode: 2})
 
 	// we could implement the publishing using a single go-routine and a channel to avoid the mutex lock/unlock
 	// but for the moment it is ok and connection issues are really rare so they won't impact performance
 	// todo investigating replacing function calling with channel use
 
-	if err != nil {
-		connectionPublisherInfo.reconnectingMutex.Lock()
-		defer connectionPublisherInfo.reconnectingMutex.Unlock()
-		if connectionPublisherInfo.GetQueueBrokerConnection().IsClosed() {
-			time.Sleep(2 * time.Second) // todo implement multiple reconnection attempts?
-			err = connectionPublisherInfo.initQueue()
-			if err != nil {
-				// todo log this
-				fmt.Println(err.Error())
-				fmt.Println("Unable to reconnect to publisher queue...")
-				os.Exit(1)
-			}
-			err = connectionPublisherInfo.GetQueueBrokerChannel().Publish(exchange,
-				key,
-				false,
-				false,
-				amqp.Publishing{Body: body, DeliveryMode: 2})
-			if err != nil {
-				// todo log this
-				fmt.Println(err.Error())
-				fmt.Println("Unable to reconnect to publisher queue...")
-				os.Exit(1)
-			}
-			fmt.Println("RECONNECTED TO PUBLISHER QUEUE")
+	// the caller decides what to do when publishing fails (retry, buffer, exit...), a broker not reachable is not always fatal
+	// there's no wait here before reconnecting, the mutex is held and the caller is the one retrying with a backoff
+	if !connectionPublisherInfo.usable() {
+		err := connectionPublisherInfo.reconnect()
+		if err != nil {
+			return errors.New(fmt.Sprintf("unable to reconnect to publisher queue: %s", err.Error()))
 		}
 	}
 
+	err := connectionPublisherInfo.GetQueueBrokerChannel().Publish(exchange,
+		key,
+		false,
+		false,
+		amqp.Publishing{Body: body, DeliveryMode: 2, Expiration: expiration})
+
+	// the channel can be closed by the broker while the connection is still open (a passive declare of a missing queue for example)
+	if err != nil && (connectionPublisherInfo.GetQueueBrokerConnection().IsClosed() || errors.Is(err, amqp.ErrClosed)) {
+		err = connectionPublisherInfo.reconnect()
+		if err != nil {
+			return errors.New(fmt.Sprintf("unable to reconnect to publisher queue: %s", err.Error()))
+		}
+		err = connectionPublisherInfo.GetQueueBrokerChannel().Publish(exchange,
+			key,
+			false,
+			false,
+			amqp.Publishing{Body: body, DeliveryMode: 2, Expiration: expiration})
+		if err != nil {
+			return errors.New(fmt.Sprintf("unable to publish after reconnecting to publisher queue: %s", err.Error()))
+		}
+		fmt.Println("RECONNECTED TO PUBLISHER QUEUE")
+	}
+
+	return err
+}
+
+// usable returns false if the connection was never established or the last (re)connection failed halfway
+func (ci *connectionInfoType) usable() bool {
+	return !ci.connectionFailure && ci.queueBrokerConnection != nil && !ci.queueBrokerConnection.IsClosed() && ci.queueBrokerChannel != nil
+}
+
+// reconnect dials the broker again, a failed attempt leaves the connection not usable and the next publish dials again
+func (ci *connectionInfoType) reconnect() error {
+	ci.reconnectingMutex.Lock()
+	defer ci.reconnectingMutex.Unlock()
+
+	if ci.queueBrokerConnection != nil && !ci.queueBrokerConnection.IsClosed() {
+		_ = ci.queueBrokerConnection.Close()
+	}
+	err := ci.initQueue()
+	ci.connectionFailure = err != nil
+
 	return err
 }
@@ -11,6 +11,7 @@ import (
 	"brainyping/pkg/dbhelper"
 	"brainyping/pkg/utilities"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -102,3 +103,42 @@ func GetRegionsList() ([]dbhelper.RegionType, error) {
 
 	return regions, nil
 }
+
+// ReloadRegionsList reads the regions from the settings collection and refreshes the value loaded at boot
+// used to apply regions/subregions changes (enabled flags for example) without restarting the app
+func ReloadRegionsList() ([]dbhelper.RegionType, error) {
+	var setting dbhelper.SettingType
+
+	err := dbhelper.GetClient().Database(dbhelper.GetDatabaseName()).Collection(dbhelper.TablenameSettings).FindOne(nil, bson.M{"key": dbhelper.GLOBREGIONS}).Decode(&setting)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error while reloading regions list: %s", err.Error()))
+	}
+	err = os.Setenv(dbhelper.GLOBREGIONS, setting.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetRegionsList()
+}
+
+// EnabledSubRegions returns the region.subregion keys that can receive new checks, both region and subregion need to be enabled
+func EnabledSubRegions(regions []dbhelper.RegionType) map[string]bool {
+	var enabled = map[string]bool{}
+
+	for _, r := range regions {
+		if !r.Enabled {
+			continue
+		}
+		for _, sr := range r.SubRegions {
+			if sr.Enabled {
+				enabled[SubRegionKey(r.Id, sr.Id)] = true
+			}
+		}
+	}
+
+	return enabled
+}
+
+func SubRegionKey(region string, subRegion string) string {
+	return fmt.Sprintf("%s.%s", region, subRegion)
+}